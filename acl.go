@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// ACLRule lets some peers of a mesh reach this host.  Peers are named by host
+// name or public key, or "*" for all of them, and Tags match the tags of the
+// hosts.  Protocol is tcp, udp, icmp or empty for any, and Ports are numbers
+// or ranges like 8000-8080, empty for all.
+type ACLRule struct {
+	Peers    []string `json:"peers,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    []string `json:"ports,omitempty"`
+}
+
+// ACL is a rule resolved against the peers of a mesh, with the networks the
+// allowed traffic can come from
+type ACL struct {
+	Sources  []string `json:"sources"`
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    []string `json:"ports,omitempty"`
+}
+
+// firewalls is what SetFirewall was last called with for each mesh
+var (
+	firewalls    = make(map[string]string)
+	firewallLock sync.Mutex
+)
+
+// PolicyPath is the file of local ACL rules, by mesh name, which are added to
+// those from meshify
+func PolicyPath() string {
+	return GetDataPath() + "policy.json"
+}
+
+// LoadPolicies reads the ACL rules of every mesh.  meshify sends them as acls
+// in the config of a mesh.  A mesh with no rules is not firewalled.
+func LoadPolicies() (map[string][]ACLRule, error) {
+	policies := make(map[string][]ACLRule)
+	for _, id := range Identities() {
+		data, err := ioutil.ReadFile(id.ConfPath())
+		if err != nil {
+			continue
+		}
+		var msg struct {
+			Config []struct {
+				MeshName string    `json:"meshName"`
+				ACLs     []ACLRule `json:"acls"`
+			} `json:"config"`
+		}
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		for _, mesh := range msg.Config {
+			policies[mesh.MeshName] = append(policies[mesh.MeshName], mesh.ACLs...)
+		}
+	}
+
+	data, err := ioutil.ReadFile(PolicyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return policies, err
+	}
+	local := make(map[string][]ACLRule)
+	err = json.Unmarshal(data, &local)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", PolicyPath(), err)
+	}
+	for mesh, rules := range local {
+		policies[mesh] = append(policies[mesh], rules...)
+	}
+	return policies, nil
+}
+
+func (r ACLRule) validate() error {
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return fmt.Errorf("invalid protocol %s", r.Protocol)
+	}
+	if r.Protocol == "icmp" && len(r.Ports) > 0 {
+		return fmt.Errorf("icmp has no ports")
+	}
+	for _, port := range r.Ports {
+		for _, p := range strings.SplitN(port, "-", 2) {
+			n, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("invalid port %s", port)
+			}
+		}
+	}
+	return nil
+}
+
+func (r ACLRule) matches(host model.Host) bool {
+	for _, peer := range r.Peers {
+		if peer == "*" || peer == host.Name || peer == host.Current.PublicKey {
+			return true
+		}
+	}
+	for _, tag := range r.Tags {
+		for _, t := range host.Tags {
+			if tag == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ResolveACLs turns the rules of a mesh into what the firewall allows.  The
+// traffic of a peer can come from any of its AllowedIPs, since wireguard
+// drops the rest.  nil means there are no rules and nothing is blocked.
+func ResolveACLs(meshName string, rules []ACLRule, host model.Host, peers []model.Host) ([]ACL, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	acls := make([]ACL, 0, len(rules)+1)
+	for i, rule := range rules {
+		err := rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("ACL rule %d of %s: %v", i+1, meshName, err)
+		}
+
+		sources := make([]string, 0)
+		for _, peer := range peers {
+			if peer.Enable && rule.matches(peer) {
+				sources = append(sources, peer.Current.AllowedIPs...)
+			}
+		}
+		if len(sources) == 0 {
+			log.Infof("ACL rule %d of %s matches no peers", i+1, meshName)
+			continue
+		}
+		acls = append(acls, ACL{Sources: normalizeCIDRs(sources), Protocol: rule.Protocol, Ports: rule.Ports})
+	}
+
+	// the DNS server of this host answers every peer
+	if host.Current.EnableDns {
+		sources := make([]string, 0)
+		for _, peer := range peers {
+			sources = append(sources, peer.Current.AllowedIPs...)
+		}
+		if len(sources) > 0 {
+			acls = append(acls, ACL{Sources: normalizeCIDRs(sources), Ports: []string{"53"}})
+		}
+	}
+	return acls, nil
+}
+
+// normalizeCIDRs masks, sorts and removes duplicates from a list of CIDRs
+func normalizeCIDRs(cidrs []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			continue
+		}
+		s := p.Masked().String()
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func firewallSignature(acls []ACL) string {
+	if acls == nil {
+		return ""
+	}
+	data, _ := json.Marshal(acls)
+	return string(data)
+}
+
+// firewallChanged is true if SetFirewall needs calling for a mesh
+func firewallChanged(meshName string, acls []ACL) bool {
+	firewallLock.Lock()
+	defer firewallLock.Unlock()
+
+	return firewalls[meshName] != firewallSignature(acls)
+}
+
+// applyFirewall replaces the firewall of a mesh, or removes it for nil
+func applyFirewall(meshName string, acls []ACL) error {
+	err := SetFirewall(meshName, acls)
+	if err != nil {
+		return err
+	}
+
+	firewallLock.Lock()
+	defer firewallLock.Unlock()
+	if acls == nil {
+		delete(firewalls, meshName)
+	} else {
+		firewalls[meshName] = firewallSignature(acls)
+	}
+	return nil
+}
@@ -2,73 +2,66 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/meshify-app/meshify/model"
-	util "github.com/meshify-app/meshify/util"
 	log "github.com/sirupsen/logrus"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var meshifyHostAPIFmt = "%s/api/v1.0/host/%s/status"
 var meshifyHostUpdateAPIFmt = "%s/api/v1.0/host/%s"
-var client *http.Client = nil
 
-// Start the channel that iterates the meshify update function
-func StartChannel(c chan []byte) {
+// Start the channel that iterates the meshify update function.  The content
+// names the identity to poll, or is empty to poll all of them.
+func StartChannel(ctx context.Context, c chan []byte) error {
 
 	log.Infof("StartChannel Meshify Host %s", config.MeshifyHost)
-	etag := ""
 	var err error
 
 	for {
-		content := <-c
+		var content []byte
+		select {
+		case <-ctx.Done():
+			return nil
+		case content = <-c:
+		}
 		if content == nil {
-			break
+			return nil
 		}
 
-		etag, err = GetMeshifyConfig(etag)
-		if err != nil {
-			log.Errorf("Error getting meshify config: %v", err)
+		for _, id := range Identities() {
+			if len(content) > 0 && string(content) != id.String() {
+				continue
+			}
+			id.etag, err = GetMeshifyConfig(ctx, id, id.etag)
+			if IsBackoff(err) {
+				log.Debugf("Not getting meshify config for %s: %v", id, err)
+			} else if err != nil {
+				log.Errorf("Error getting meshify config for %s: %v", id, err)
+			}
 		}
 	}
 }
 
-func CallMeshify(etag *string) ([]byte, error) {
+func CallMeshify(id *Identity, etag *string) ([]byte, error) {
 
-	host := config.MeshifyHost
+	ctl := id.Controllers().Active()
+	host := ctl.URL
 
-	if client == nil {
-		if strings.HasPrefix(host, "http:") {
-			client = &http.Client{
-				Timeout: time.Second * 10,
-			}
-		} else {
-			// Create a transport like http.DefaultTransport, but with the configured LocalAddr
-			transport := &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				Dial: (&net.Dialer{
-					Timeout:   5 * time.Second,
-					KeepAlive: 60 * time.Second,
-					LocalAddr: config.sourceAddr,
-				}).Dial,
-				TLSHandshakeTimeout: 10 * time.Second,
-			}
-			client = &http.Client{
-				Transport: transport,
-			}
-
-		}
+	client, err := HTTPClient()
+	if err != nil {
+		return nil, err
 	}
 
-	var reqURL string = fmt.Sprintf(meshifyHostAPIFmt, host, config.HostID)
+	var reqURL string = fmt.Sprintf(meshifyHostAPIFmt, host, id.HostID)
 	if !config.Quiet {
 		log.Infof("  GET %s", reqURL)
 	}
@@ -78,25 +71,40 @@ func CallMeshify(etag *string) ([]byte, error) {
 		return nil, err
 	}
 	if req != nil {
-		req.Header.Set("X-API-KEY", config.ApiKey)
-		req.Header.Set("User-Agent", "meshify-client/1.0")
+		req.Header.Set("X-API-KEY", id.ApiKey)
+		req.Header.Set("User-Agent", userAgent())
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("If-None-Match", *etag)
 	}
+
+	// don't call the server while we are backing off from earlier failures.
+	// The host policy never probes, so it goes first.
+	if err := id.Policy().Check(); err != nil {
+		return nil, err
+	}
+	if err := ctl.Policy.Check(); err != nil {
+		return nil, err
+	}
 	resp, err := client.Do(req)
 	if err == nil {
+		defer resp.Body.Close()
 		if resp.StatusCode == 304 {
-			buffer, err := ioutil.ReadFile(GetDataPath() + "meshify.conf")
+			ctl.Policy.Record(id.Policy(), nil)
+			id.RotateApiKey(ctl, resp.Header)
+			buffer, err := ioutil.ReadFile(id.ConfPath())
 			if err == nil {
 				return buffer, nil
 			}
 
-		} else if resp.StatusCode == 401 {
-			return nil, fmt.Errorf("Unauthorized")
 		} else if resp.StatusCode != 200 {
-			log.Errorf("Response Error Code: %v", resp.StatusCode)
-			return nil, fmt.Errorf("response error code: %v", resp.StatusCode)
+			err = NewAPIError(resp)
+			ctl.Policy.Record(id.Policy(), err)
+			if !IsUnauthorized(err) {
+				log.Errorf("Response Error Code: %v", resp.StatusCode)
+			}
+			return nil, err
 		} else {
+			ctl.Policy.Record(id.Policy(), nil)
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				log.Errorf("error reading body %v", err)
@@ -105,6 +113,16 @@ func CallMeshify(etag *string) ([]byte, error) {
 
 			etag2 := resp.Header.Get("ETag")
 
+			// refuse anything not signed by the controller, and keep the old etag so we fetch it again
+			err = VerifyMessage(id, body, resp.Header.Get(signatureHeader))
+			if err != nil {
+				RejectMessage(ctl, meshifyHostRejectAPIFmt, id.HostID, id.ApiKey, etag2, err)
+				id.Policy().Failure(err)
+				return nil, err
+			}
+
+			id.RotateApiKey(ctl, resp.Header)
+
 			if *etag != etag2 {
 				log.Infof("etag = %s  etag2 = %s", *etag, etag2)
 				*etag = etag2
@@ -116,6 +134,7 @@ func CallMeshify(etag *string) ([]byte, error) {
 			return body, nil
 		}
 	} else {
+		ctl.Policy.Record(id.Policy(), err)
 		log.Errorf("ERROR: %v, continuing", err)
 	}
 
@@ -123,7 +142,7 @@ func CallMeshify(etag *string) ([]byte, error) {
 
 }
 
-func GetMeshifyConfig(etag string) (string, error) {
+func GetMeshifyConfig(ctx context.Context, id *Identity, etag string) (string, error) {
 
 	if !config.loaded {
 		err := loadConfig()
@@ -132,56 +151,30 @@ func GetMeshifyConfig(etag string) (string, error) {
 		}
 	}
 
-	body, err := CallMeshify(&etag)
+	body, err := CallMeshify(id, &etag)
 	if err != nil {
-		if err.Error() == "Unauthorized" {
-			log.Errorf("Unauthorized - looking for another API key")
-			// Read the config and find another API key
-			buffer, err := ioutil.ReadFile(GetDataPath() + "meshify.conf")
-			if err == nil {
-				var conf model.Message
-				err = json.Unmarshal(buffer, &conf)
-				if err == nil {
-					found := false
-					for _, mesh := range conf.Config {
-						for _, host := range mesh.Hosts {
-
-							if host.HostGroup == config.HostID && host.APIKey != config.ApiKey {
-								config.ApiKey = host.APIKey
-								saveConfig()
-								log.Infof("Trying %s %s", host.HostGroup, host.APIKey)
-								body, err = CallMeshify(&etag)
-								if err == nil {
-									log.Infof("Found working API key - etag %s", etag)
-									found = true
-									UpdateMeshifyConfig(body)
-									return etag, nil
-								}
-							}
-						}
-					}
-					if !found {
-						if len(conf.Config) == 1 {
-							// Only one mesh and getting a 401, so lets delete that mesh too
-							err = os.Remove(GetDataPath() + "meshify.conf")
-							if err != nil {
-								log.Errorf("Failed to delete meshify.conf")
-							}
-						}
-					}
-				}
+		if IsUnauthorized(err) {
+			log.Errorf("Unauthorized - trying the announced and previous API keys")
+			body, err2 := id.RecoverApiKey(&etag)
+			if err2 == nil {
+				log.Infof("Found working API key - etag %s", etag)
+				UpdateMeshifyConfig(ctx, id, body, etag)
+				return etag, nil
 			}
+			// the meshes keep running on the config we have until the key is fixed
+			log.Errorf("%v, keeping the current config", err2)
+
 			// pick up any changes from the agent or manually editing the config file.
 			reloadConfig()
 
 			// start a new http connection in case the host changes
-			client = nil
+			ResetHTTPClient()
 
-		} else {
+		} else if !IsBackoff(err) {
 			log.Error(err)
 		}
 	} else {
-		UpdateMeshifyConfig(body)
+		UpdateMeshifyConfig(ctx, id, body, etag)
 		return etag, nil
 	}
 
@@ -191,28 +184,16 @@ func GetMeshifyConfig(etag string) (string, error) {
 func UpdateMeshifyHost(host model.Host) error {
 
 	log.Infof("UPDATING HOST: %v", host)
-	server := config.MeshifyHost
-	var client *http.Client
-
-	if strings.HasPrefix(server, "http:") {
-		client = &http.Client{
-			Timeout: time.Second * 10,
-		}
-	} else {
-		// Create a transport like http.DefaultTransport, but with the configured LocalAddr
-		transport := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 60 * time.Second,
-				LocalAddr: config.sourceAddr,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
-		client = &http.Client{
-			Transport: transport,
-		}
+	// use the controller of the identity the host belongs to
+	ctl := ActiveController()
+	if id := IdentityFor(host.HostGroup); id != nil {
+		ctl = id.Controllers().Active()
+	}
+	server := ctl.URL
 
+	client, err := HTTPClient()
+	if err != nil {
+		return err
 	}
 
 	var reqURL string = fmt.Sprintf(meshifyHostUpdateAPIFmt, server, host.Id)
@@ -228,14 +209,19 @@ func UpdateMeshifyHost(host model.Host) error {
 	}
 	if req != nil {
 		req.Header.Set("X-API-KEY", host.APIKey)
-		req.Header.Set("User-Agent", "meshify-client/1.0")
+		req.Header.Set("User-Agent", userAgent())
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	if err := ctl.Policy.Check(); err != nil {
+		log.Errorf("Not updating host %s: %v", host.Name, err)
+		return err
+	}
 	resp, err := client.Do(req)
 	if err == nil {
 		if resp.StatusCode != 200 {
 			log.Errorf("PATCH Error: Response %v", resp.StatusCode)
+			err = NewAPIError(resp)
 		} else {
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
@@ -244,6 +230,7 @@ func UpdateMeshifyHost(host model.Host) error {
 			log.Infof("%s", string(body))
 		}
 	}
+	ctl.Policy.Record(nil, err)
 
 	if resp != nil {
 		resp.Body.Close()
@@ -252,24 +239,26 @@ func UpdateMeshifyHost(host model.Host) error {
 		req.Body.Close()
 	}
 
-	return nil
+	return err
 }
 
-// UpdateMeshifyConfig updates the config from the server
-func UpdateMeshifyConfig(body []byte) {
+// UpdateMeshifyConfig updates the config of an identity from the server
+func UpdateMeshifyConfig(ctx context.Context, id *Identity, body []byte, etag string) {
+
+	confPath := id.ConfPath()
 
 	// If the file doesn't exist create it for the first time
-	if _, err := os.Stat(GetDataPath() + "meshify.conf"); os.IsNotExist(err) {
-		file, err := os.OpenFile(GetDataPath()+"meshify.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if _, err := os.Stat(confPath); os.IsNotExist(err) {
+		file, err := os.OpenFile(confPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 		if err == nil {
 			file.Close()
 		}
 	}
 
-	file, err := os.Open(GetDataPath() + "meshify.conf")
+	file, err := os.Open(confPath)
 
 	if err != nil {
-		log.Errorf("Error opening meshify.conf file %v", err)
+		log.Errorf("Error opening %s file %v", confPath, err)
 		return
 	}
 	conf, err := ioutil.ReadAll(file)
@@ -282,8 +271,11 @@ func UpdateMeshifyConfig(body []byte) {
 	// compare the body to the current config and make no changes if they are the same
 	if bytes.Equal(conf, body) {
 		return
+	} else if id.KeepPin(body) {
+		// a local rollback holds until meshify has something new
+		return
 	} else {
-		log.Info("Config has changed, updating meshify.conf")
+		log.Infof("Config has changed, updating %s", confPath)
 
 		// if we can't read the message, immediately return
 		var msg model.Message
@@ -293,15 +285,20 @@ func UpdateMeshifyConfig(body []byte) {
 			return
 		}
 
-		file, err := os.OpenFile(GetDataPath()+"meshify.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		err = RecordHistory(id, body, etag)
+		if err != nil {
+			log.Errorf("Error saving config history: %v", err)
+		}
+
+		file, err := os.OpenFile(confPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 		if err != nil {
-			log.Errorf("Error opening meshify.conf for write: %v", err)
+			log.Errorf("Error opening %s for write: %v", confPath, err)
 			return
 		}
 		_, err = file.Write(body)
 		file.Close()
 		if err != nil {
-			log.Infof("Error writing meshify.conf file: %v", err)
+			log.Infof("Error writing %s file: %v", confPath, err)
 			return
 		}
 
@@ -313,364 +310,156 @@ func UpdateMeshifyConfig(body []byte) {
 
 		log.Debugf("%v", msg)
 
-		// make a copy of the message since UpdateDNS will alter it.
-		var msg2 model.Message
-		json.Unmarshal(body, &msg2)
-		err = UpdateDNS(msg2)
+		// DNS serves the meshes of every identity
+		msg2, err := LoadMessages()
+		if err == nil {
+			err = UpdateDNS(msg2)
+		}
 		if err != nil {
 			log.Errorf("Error updating DNS configuration: %v", err)
 		}
 
-		// Get our local subnets, called here to avoid duplication
-		subnets, err := GetLocalSubnets()
+		// meshes that are in the old message and not the new one get deleted
+		RememberMeshes(id, oldconf)
+		_, err = Reconcile(ctx, "new config for "+id.String())
 		if err != nil {
-			log.Errorf("GetLocalSubnets, err = ", err)
-		}
-
-		// first, delete any meshes that are no longer in the conf
-		for i := 0; i < len(oldconf.Config); i++ {
-			found := false
-			for j := 0; j < len(msg.Config); j++ {
-				if oldconf.Config[i].MeshName == msg.Config[j].MeshName {
-					found = true
-					break
-				}
-			}
-			if !found {
-				log.Infof("Deleting mesh %v", oldconf.Config[i].MeshName)
-				StopWireguard(oldconf.Config[i].MeshName)
-				os.Remove(GetDataPath() + oldconf.Config[i].MeshName + ".conf")
-
-				for _, host := range oldconf.Config[i].Hosts {
-					if host.HostGroup == config.HostID {
-						KeyDelete(host.Current.PublicKey)
-						KeySave()
-					}
-				}
-			}
-		}
-
-		// handle any other changes
-		for i := 0; i < len(msg.Config); i++ {
-			index := -1
-			for j := 0; j < len(msg.Config[i].Hosts); j++ {
-				if msg.Config[i].Hosts[j].HostGroup == config.HostID {
-					index = j
-					break
-				}
-			}
-			if index == -1 {
-				log.Errorf("Error reading message %v", msg)
-			} else {
-				host := msg.Config[i].Hosts[index]
-				msg.Config[i].Hosts = append(msg.Config[i].Hosts[:index], msg.Config[i].Hosts[index+1:]...)
-
-				// Configure UPnP as needed
-				go ConfigureUPnP(host)
-
-				// If any of the AllowedIPs contain our subnet, remove that entry
-				for k := 0; k < len(msg.Config[i].Hosts); k++ {
-					allowed := msg.Config[i].Hosts[k].Current.AllowedIPs
-					for l := 0; l < len(allowed); l++ {
-						inSubnet := false
-						_, s, _ := net.ParseCIDR(allowed[l])
-						for _, subnet := range subnets {
-							if subnet.Contains(s.IP) {
-								inSubnet = true
-							}
-						}
-						if inSubnet {
-							msg.Config[i].Hosts[k].Current.AllowedIPs = append(allowed[:l], allowed[l+1:]...)
-						}
-					}
-				}
-
-				// Check to see if we have the private key
-
-				key, found := KeyLookup(host.Current.PublicKey)
-				if !found {
-					KeyAdd(host.Current.PublicKey, host.Current.PrivateKey)
-					err = KeySave()
-					if err != nil {
-						log.Errorf("Error saving key: %s %s", host.Current.PublicKey, host.Current.PrivateKey)
-					}
-					key, _ = KeyLookup(host.Current.PublicKey)
-				}
-
-				// If the private key is blank create a new one and update the server
-				if key == "" {
-					// delete the old public key
-					KeyDelete(host.Current.PublicKey)
-					wg, _ := wgtypes.GeneratePrivateKey()
-					host.Current.PrivateKey = wg.String()
-					host.Current.PublicKey = wg.PublicKey().String()
-					KeyAdd(host.Current.PublicKey, host.Current.PrivateKey)
-					KeySave()
-
-					host2 := host
-					host2.Current.PrivateKey = ""
-
-					// Update meshify with the new public key
-					UpdateMeshifyHost(host2)
-
-				} else {
-					host.Current.PrivateKey = key
-				}
-
-				text, err := DumpWireguardConfig(&host, &(msg.Config[i].Hosts))
-				if err != nil {
-					log.Errorf("error on template: %s", err)
-				}
-
-				// Check the current file and if it's an exact match, do not bounce the service
-				path := GetWireguardPath()
-
-				force := false
-				var bits []byte
-
-				file, err := os.Open(path + msg.Config[i].MeshName + ".conf")
-				if err != nil {
-					log.Errorf("Error opening %s for read: %v", msg.Config[i].MeshName, err)
-					force = true
-				} else {
-					bits, err = ioutil.ReadAll(file)
-					file.Close()
-					if err != nil {
-						log.Errorf("Error reading meshify config file: %v", err)
-						force = true
-					}
-				}
-
-				if !force && bytes.Equal(bits, text) {
-					log.Infof("*** SKIPPING %s *** No changes!", msg.Config[i].MeshName)
-				} else {
-					err = StopWireguard(msg.Config[i].MeshName)
-					if err != nil {
-						log.Errorf("Error stopping wireguard: %v", err)
-					}
-
-					err = util.WriteFile(path+msg.Config[i].MeshName+".conf", text)
-					if err != nil {
-						log.Errorf("Error writing file %s : %s", path+msg.Config[i].MeshName+".conf", err)
-					}
-
-					if !host.Enable {
-						// Host was disabled when we stopped wireguard above
-						log.Infof("Mesh %s is disabled.  Stopped service if running.", msg.Config[i].MeshName)
-						// Stopping the service doesn't seem very reliable, stop it again
-						if err = StopWireguard(msg.Config[i].MeshName); err != nil {
-							log.Errorf("Error stopping wireguard: %v", err)
-						}
-
-					} else {
-						err = StartWireguard(msg.Config[i].MeshName)
-						if err == nil {
-							log.Infof("Started %s", msg.Config[i].MeshName)
-							log.Infof("%s Config: %v", msg.Config[i].MeshName, msg.Config[i])
-						}
-					}
-				}
-
-			}
+			log.Errorf("Error applying config: %v", err)
 		}
 	}
 
 }
 
-func GetLocalSubnets() ([]*net.IPNet, error) {
+// GetLocalSubnets returns the networks of the interfaces that are up, other
+// than loopback and the named mesh interfaces, whose addresses are in the mesh
+func GetLocalSubnets(meshes map[string]bool) ([]netip.Prefix, error) {
 	ifaces, err := net.Interfaces()
 
 	if err != nil {
 		return nil, err
 	}
 
-	subnets := make([]*net.IPNet, 0)
+	subnets := make([]netip.Prefix, 0)
 
 	for _, i := range ifaces {
-		addrs, err := i.Addrs()
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 || meshes[i.Name] {
+			continue
+		}
+		s, err := interfaceSubnets(i)
 		if err != nil {
 			return nil, err
 		}
+		subnets = append(subnets, s...)
+	}
+	return subnets, nil
+}
+
+// interfaceSubnets lists the networks an interface is on, leaving out link-local ones
+func interfaceSubnets(i net.Interface) ([]netip.Prefix, error) {
+	addrs, err := i.Addrs()
+	if err != nil {
+		return nil, err
+	}
 
-		for _, addr := range addrs {
-			switch v := addr.(type) {
-			case *net.IPNet:
-				subnets = append(subnets, v)
+	subnets := make([]netip.Prefix, 0)
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip, ok := netip.AddrFromSlice(v.IP)
+			if !ok || ip.IsLinkLocalUnicast() {
+				continue
 			}
+			ones, _ := v.Mask.Size()
+			subnets = append(subnets, netip.PrefixFrom(ip.Unmap(), ones).Masked())
 		}
 	}
 	return subnets, nil
 }
 
-func StartBackgroundRefreshService() {
+// meshNames is the set of mesh names in a message, which are also the names
+// of their interfaces
+func meshNames(msg model.Message) map[string]bool {
+	names := make(map[string]bool)
+	for _, mesh := range msg.Config {
+		names[mesh.MeshName] = true
+	}
+	return names
+}
 
-	for {
+func StartBackgroundRefreshService(ctx context.Context) error {
 
-		file, err := os.Open(GetDataPath() + "meshify.conf")
-		if err != nil {
-			log.Errorf("Error opening meshify.conf for read: %v", err)
-			return
-		}
-		bytes, err := ioutil.ReadAll(file)
-		file.Close()
-		if err != nil {
-			log.Errorf("Error reading meshify config file: %v", err)
-			return
-		}
-		var msg model.Message
-		err = json.Unmarshal(bytes, &msg)
+	for {
+		_, err := Reconcile(ctx, "refresh")
 		if err != nil {
-			log.Errorf("Error reading message from server")
+			return fmt.Errorf("error reading meshify config: %v", err)
 		}
+		StartDNS(ctx)
 
-		log.Debugf("%v", msg)
-
-		// Get our local subnets, called here to avoid duplication
-		subnets, err := GetLocalSubnets()
-		if err != nil {
-			log.Errorf("GetLocalSubnets, err = ", err)
+		// Do this startup process every hour.  Keeps UPnP ports active, handles laptop sleeps, etc.
+		if !sleepContext(ctx, 60*time.Minute) {
+			return nil
 		}
+	}
+}
 
-		for i := 0; i < len(msg.Config); i++ {
-			index := -1
-			for j := 0; j < len(msg.Config[i].Hosts); j++ {
-				if msg.Config[i].Hosts[j].HostGroup == config.HostID {
-					index = j
-					break
-				}
-			}
-			if index == -1 {
-				log.Errorf("Error reading message %v", msg)
-			} else {
-				host := msg.Config[i].Hosts[index]
-				msg.Config[i].Hosts = append(msg.Config[i].Hosts[:index], msg.Config[i].Hosts[index+1:]...)
-
-				// Configure UPnP as needed
-				go ConfigureUPnP(host)
-
-				// If any of the AllowedIPs contain our subnet, remove that entry
-				for k := 0; k < len(msg.Config[i].Hosts); k++ {
-					allowed := msg.Config[i].Hosts[k].Current.AllowedIPs
-					for l := 0; l < len(allowed); l++ {
-						inSubnet := false
-						_, s, _ := net.ParseCIDR(allowed[l])
-						for _, subnet := range subnets {
-							if subnet.Contains(s.IP) {
-								inSubnet = true
-							}
-						}
-						if inSubnet {
-							msg.Config[i].Hosts[k].Current.AllowedIPs = append(allowed[:l], allowed[l+1:]...)
-						}
-					}
-				}
-				// Check to see if we have the private key
-
-				key, found := KeyLookup(host.Current.PublicKey)
-				if !found {
-					KeyAdd(host.Current.PublicKey, host.Current.PrivateKey)
-					err = KeySave()
-					if err != nil {
-						log.Errorf("Error saving key: %s %s", host.Current.PublicKey, host.Current.PrivateKey)
-					}
-					key, _ = KeyLookup(host.Current.PublicKey)
-				}
-
-				// If the private key is blank create a new one and update the server
-				if key == "" {
-					// delete the old public key
-					KeyDelete(host.Current.PublicKey)
-					wg, _ := wgtypes.GeneratePrivateKey()
-					host.Current.PrivateKey = wg.String()
-					host.Current.PublicKey = wg.PublicKey().String()
-					KeyAdd(host.Current.PublicKey, host.Current.PrivateKey)
-					KeySave()
-
-					host2 := host
-					host2.Current.PrivateKey = ""
-
-					// Update meshify with the new public key
-					UpdateMeshifyHost(host2)
-
-				} else {
-					host.Current.PrivateKey = key
-				}
-
-				text, err := DumpWireguardConfig(&host, &(msg.Config[i].Hosts))
-				if err != nil {
-					log.Errorf("error on template: %s", err)
-				}
-				path := GetWireguardPath()
-				err = util.WriteFile(path+msg.Config[i].MeshName+".conf", text)
-				if err != nil {
-					log.Errorf("Error writing file %s : %s", path+msg.Config[i].MeshName+".conf", err)
-				}
-
-				if !host.Enable {
-					StopWireguard(msg.Config[i].MeshName)
-					log.Infof("Mesh %s is disabled.  Stopped service if running.", msg.Config[i].MeshName)
-				} else {
-					err = StartWireguard(msg.Config[i].MeshName)
-					if err == nil {
-						log.Infof("Started %s", msg.Config[i].MeshName)
-						log.Infof("%s Config: %v", msg.Config[i].MeshName, msg.Config[i])
-					}
-				}
-
-			}
-			StartDNS()
+// DoWork starts the host subsystems under the supervisor
+func DoWork(s *Supervisor) {
+
+	c := make(chan []byte)
+	s.Go("local API", startHTTPd)
+	s.Go("channel", func(ctx context.Context) error { return StartChannel(ctx, c) })
+	s.Go("DNS", StartDNS)
+	s.Go("refresh", StartBackgroundRefreshService)
+	s.Go("controller probe", StartControllerProbe)
+	s.Go("heartbeat", StartHeartbeat)
+	s.Go("network watcher", StartNetworkWatcher)
+	s.Go("port mappings", StartPortMappingRenewal)
+	if config.Stream {
+		for _, id := range Identities() {
+			id := id
+			s.Go("stream "+id.String(), func(ctx context.Context) error { return StartStream(ctx, id, c) })
 		}
-		// Do this startup process every hour.  Keeps UPnP ports active, handles laptop sleeps, etc.
-		time.Sleep(60 * time.Minute)
 	}
+	s.Go("poll", func(ctx context.Context) error { return poll(ctx, c) })
 }
 
-// DoWork error handler
-func DoWork() {
+// poll pokes the channel every CheckInterval
+func poll(ctx context.Context, c chan []byte) error {
 	var curTs int64
 
-	// recover from any panics coming from below
-	defer func() {
-		if r := recover(); r != nil {
-			var ok bool
-			err, ok := r.(error)
-			if !ok {
-				log.Fatalf("Fatal Error: %v", err)
-			}
-		}
-	}()
-
-	go func() {
+	// Determine current timestamp (the wallclock time we'll retrieve files using)
+	curTs = calculateCurrentTimestamp()
 
-		// Determine current timestamp (the wallclock time we'll retrieve files using)
+	t := time.Unix(curTs, 0)
+	log.Infof("current timestamp = %v (%s)", curTs, t.UTC())
 
-		c := make(chan []byte)
-		go startHTTPd()
-		go StartChannel(c)
-		go StartDNS()
-		go StartBackgroundRefreshService()
-
-		curTs = calculateCurrentTimestamp()
-
-		t := time.Unix(curTs, 0)
-		log.Infof("current timestamp = %v (%s)", curTs, t.UTC())
+	for {
+		if !sleepContext(ctx, 100*time.Millisecond) {
+			return nil
+		}
+		ts := time.Now()
 
-		for {
-			time.Sleep(100 * time.Millisecond)
-			ts := time.Now()
+		if ts.Unix() >= curTs {
 
-			if ts.Unix() >= curTs {
+			b := []byte("")
 
-				b := []byte("")
+			select {
+			case <-ctx.Done():
+				return nil
+			case c <- b:
+			}
 
-				c <- b
+			curTs = calculateCurrentTimestamp()
+			curTs += config.CheckInterval
+		}
 
-				curTs = calculateCurrentTimestamp()
-				curTs += config.CheckInterval
+		// While the server is pushing changes, the poll is only a safety net
+		for StreamActive() && time.Now().Unix() < curTs-config.CheckInterval+streamRefreshInterval {
+			if !sleepContext(ctx, 100*time.Millisecond) {
+				return nil
 			}
-
 		}
-	}()
+
+	}
 }
 
 func calculateCurrentTimestamp() int64 {
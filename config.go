@@ -1,31 +1,54 @@
 package main
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var config struct {
-	Quiet         bool
-	MeshifyHost   string
-	HostID        string
-	ApiKey        string
-	ServiceGroup  string
-	ServiceApiKey string
-	CheckInterval int64
-	tls           tls.Config
-	SourceAddress string
-	sourceAddr    *net.TCPAddr
-	Debug         bool
-	init          bool
-	loaded        bool
-	path          *string
+	Quiet             bool
+	MeshifyHost       string
+	MeshifyHosts      []string
+	HostID            string
+	ApiKey            string
+	NextApiKey        string
+	PreviousApiKey    string
+	Identities        []*Identity
+	ServiceGroup      string
+	ServiceApiKey     string
+	CheckInterval     int64
+	Stream            bool
+	FailbackInterval  int64
+	HeartbeatInterval int64
+	ShutdownTimeout   int64
+	ShutdownMeshes    bool
+	RollbackWindow    int64
+	HistorySize       int
+	WireguardDriver   string
+	SubnetRoutes      map[string][]string
+	OfferExitNode     map[string]bool
+	UseExitNode       map[string]ExitNodeConfig
+	Stun              bool
+	StunServers       []string
+	SourceAddress     string
+	sourceAddr        *net.TCPAddr
+	Proxy             string
+	Timeout           int64
+	CACert            string
+	ClientCert        string
+	ClientKey         string
+	TLSMinVersion     string
+	ControllerKey     string
+	Debug             bool
+	init              bool
+	loaded            bool
+	path              *string
 }
 
 type configError struct {
@@ -45,7 +68,29 @@ func saveConfig() error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(GetDataPath()+*config.path, data, 0600)
+	return writeFileAtomic(GetDataPath()+*config.path, data, 0600)
+}
+
+// writeFileAtomic writes a temporary file and renames it over path, so a
+// crash or full disk never leaves a half written file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 func reloadConfig() error {
@@ -58,8 +103,15 @@ func reloadConfig() error {
 		return err
 	}
 	json.Unmarshal(data, &config)
+	normalizeHosts()
+	err = ValidateIdentities()
+	if err != nil {
+		return err
+	}
+	InitControllers()
 
 	log.Infof("MeshifyHost: %s", config.MeshifyHost)
+	log.Infof("MeshifyHosts: %v", config.MeshifyHosts)
 	log.Infof("HostID: %s", config.HostID)
 	log.Infof("ApiKey: %s", config.ApiKey)
 	log.Infof("Quiet: %t", config.Quiet)
@@ -80,8 +132,18 @@ func loadConfig() error {
 		config.Debug = false
 		config.Quiet = false
 		config.CheckInterval = 10
+		config.Stream = true
+		config.FailbackInterval = 300
+		config.HeartbeatInterval = 60
+		config.ShutdownTimeout = 10
+		config.ShutdownMeshes = false
+		config.RollbackWindow = 120
+		config.HistorySize = 10
+		config.WireguardDriver = defaultDriver
+		config.StunServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
 		config.SourceAddress = "0.0.0.0"
-		config.tls.MinVersion = tls.VersionTLS10
+		config.Timeout = 10
+		config.TLSMinVersion = "1.2"
 
 		// load defaults from environment
 		config.MeshifyHost = os.Getenv("MESHIFY_HOST")
@@ -89,6 +151,8 @@ func loadConfig() error {
 		config.ApiKey = os.Getenv("MESHIFY_API_KEY")
 		config.ServiceGroup = os.Getenv("MESHIFY_SERVICE_GROUP")
 		config.ServiceApiKey = os.Getenv("MESHIFY_SERVICE_API_KEY")
+		config.CACert = os.Getenv("MESHIFY_CA_CERT")
+		config.ControllerKey = os.Getenv("MESHIFY_CONTROLLER_KEY")
 
 		if config.MeshifyHost == "" {
 			config.MeshifyHost = "https://my.meshify.app"
@@ -96,7 +160,7 @@ func loadConfig() error {
 
 		// pick up command line arguments
 		config.path = flag.String("C", "meshify-client.config.json", "Path to configuration file")
-		MeshifyHost := flag.String("server", "", "Meshify server to connect to")
+		MeshifyHost := flag.String("server", "", "Meshify server(s) to connect to, comma separated in order of preference")
 		HostID := flag.String("hostid", "", "Host ID to use")
 		ServiceGroup := flag.String("servicegroup", "", "Service group to use")
 		ServiceApiKey := flag.String("serviceapikey", "", "Service API key to use")
@@ -104,7 +168,10 @@ func loadConfig() error {
 		ApiKey := flag.String("apikey", "", "API key to use")
 		CheckInterval := flag.Int64("interval", 0, "Time interval between maps.  Default is 10 (seconds)")
 		quiet := flag.Bool("quiet", false, "Do not output to stdout (only to syslog)")
+		noStream := flag.Bool("nostream", false, "Do not hold an event stream open to the server, only poll")
 		sourceStr := flag.String("source", "", "Source address for http client requests")
+		proxy := flag.String("proxy", "", "Proxy for http client requests.  Default is from the environment")
+		caCert := flag.String("cacert", "", "PEM bundle of additional CAs to trust for the server")
 		flag.Parse()
 
 		// Open the config file specified
@@ -127,8 +194,13 @@ func loadConfig() error {
 			config.Quiet = *quiet
 		}
 
+		if *noStream {
+			config.Stream = false
+		}
+
 		if *MeshifyHost != "" {
 			config.MeshifyHost = *MeshifyHost
+			config.MeshifyHosts = nil
 		}
 		if *HostID != "" {
 			config.HostID = *HostID
@@ -144,9 +216,14 @@ func loadConfig() error {
 			config.ServiceApiKey = *ServiceApiKey
 		}
 
+		normalizeHosts()
 		if config.MeshifyHost == "" {
 			return &configError{"A meshify-client.config.json file with a MeshifyHost parameter is required"}
 		}
+		err = ValidateIdentities()
+		if err != nil {
+			return err
+		}
 
 		if *CheckInterval != 0 {
 			config.CheckInterval = *CheckInterval
@@ -156,15 +233,33 @@ func loadConfig() error {
 			config.SourceAddress = *sourceStr
 		}
 
+		if *proxy != "" {
+			config.Proxy = *proxy
+		}
+		if *caCert != "" {
+			config.CACert = *caCert
+		}
+
 		config.sourceAddr, err = net.ResolveTCPAddr("tcp", config.SourceAddress+":0")
 		if err != nil {
 			return err
 		}
+		InitControllers()
 		config.loaded = true
 		log.Infof("MeshifyHost: %s", config.MeshifyHost)
+		log.Infof("MeshifyHosts: %v", config.MeshifyHosts)
 		log.Infof("HostID: %s", config.HostID)
 		log.Infof("ApiKey: %s", config.ApiKey)
+		for _, id := range config.Identities {
+			log.Infof("Identity %s: HostID: %s", id.Name, id.HostID)
+			if id.ControllerKey != "" {
+				log.Infof("Identity %s: ControllerKey: %s", id.Name, id.ControllerKey)
+			}
+		}
 		log.Infof("Quiet: %t", config.Quiet)
+		if config.ControllerKey == "" {
+			log.Infof("No ControllerKey, config from the server will not be verified")
+		}
 
 	} else {
 		file, err := os.Open(GetDataPath() + *config.path)
@@ -176,8 +271,15 @@ func loadConfig() error {
 		if err != nil {
 			return err
 		}
+		normalizeHosts()
+		err = ValidateIdentities()
+		if err != nil {
+			return err
+		}
+		InitControllers()
 
 		log.Infof("MeshifyHost: %s", config.MeshifyHost)
+		log.Infof("MeshifyHosts: %v", config.MeshifyHosts)
 		log.Infof("HostID: %s", config.HostID)
 		log.Infof("ApiKey: %s", config.ApiKey)
 		log.Infof("Quiet: %t", config.Quiet)
@@ -186,3 +288,28 @@ func loadConfig() error {
 	}
 	return nil
 }
+
+// normalizeHosts makes MeshifyHosts the ordered list of controllers, with
+// MeshifyHost as the primary.  MeshifyHost may itself be a comma separated list.
+func normalizeHosts() {
+	hosts := splitHosts(config.MeshifyHost)
+	if len(config.MeshifyHosts) == 0 {
+		config.MeshifyHosts = hosts
+	} else if len(hosts) > 0 {
+		found := false
+		for _, host := range config.MeshifyHosts {
+			if host == hosts[0] {
+				found = true
+			}
+		}
+		if !found {
+			config.MeshifyHosts = append([]string{hosts[0]}, config.MeshifyHosts...)
+		}
+	}
+	config.MeshifyHosts = splitHosts(strings.Join(config.MeshifyHosts, ","))
+
+	config.MeshifyHost = ""
+	if len(config.MeshifyHosts) > 0 {
+		config.MeshifyHost = config.MeshifyHosts[0]
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fail over to the next controller after this many outages in a row
+const failoverThreshold = 2
+
+// Controller is one meshify server the agent can talk to
+type Controller struct {
+	URL    string
+	Policy *RetryPolicy
+}
+
+// ControllerSet is an ordered list of controllers, the first being the primary
+type ControllerSet struct {
+	list  []*Controller
+	index int
+	lock  sync.Mutex
+}
+
+// Controllers is built from config.MeshifyHosts and used by every identity
+// that doesn't name its own MeshifyHost
+var Controllers = &ControllerSet{}
+
+// InitControllers builds the controller lists from config, keeping the retry
+// state of any controller that is still configured
+func InitControllers() {
+	Controllers.Set(config.MeshifyHosts)
+	for _, id := range config.Identities {
+		if id.MeshifyHost == "" {
+			id.controllers = nil
+			continue
+		}
+		if id.controllers == nil {
+			id.controllers = &ControllerSet{}
+		}
+		id.controllers.Set(splitHosts(id.MeshifyHost))
+	}
+}
+
+// Set replaces the list of controller URLs
+func (cs *ControllerSet) Set(urls []string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	active := ""
+	if cs.index < len(cs.list) {
+		active = cs.list[cs.index].URL
+	}
+
+	controllers := make([]*Controller, 0, len(urls))
+	index := 0
+	for _, url := range urls {
+		var ctl *Controller
+		for _, old := range cs.list {
+			if old.URL == url {
+				ctl = old
+			}
+		}
+		if ctl == nil {
+			ctl = &Controller{URL: url, Policy: NewRetryPolicy(url, true)}
+			ctl.Policy.OnFailure = cs.failed
+		}
+		if url == active {
+			index = len(controllers)
+		}
+		controllers = append(controllers, ctl)
+	}
+
+	cs.list = controllers
+	cs.index = index
+}
+
+// Active returns the controller calls should currently go to
+func (cs *ControllerSet) Active() *Controller {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if len(cs.list) == 0 {
+		// config hasn't been loaded yet
+		return &Controller{URL: config.MeshifyHost, Policy: controlPlane}
+	}
+	return cs.list[cs.index]
+}
+
+// ActiveController returns the active controller of the default set
+func ActiveController() *Controller {
+	return Controllers.Active()
+}
+
+// failed is called after every outage recorded against a controller in the set
+func (cs *ControllerSet) failed(p *RetryPolicy) {
+	if p.Status().Failures < failoverThreshold {
+		return
+	}
+
+	cs.lock.Lock()
+	if len(cs.list) < 2 || cs.list[cs.index].Policy != p {
+		cs.lock.Unlock()
+		return
+	}
+
+	// pick the next controller that isn't itself backing off
+	from := cs.list[cs.index].URL
+	for i := 1; i < len(cs.list); i++ {
+		next := (cs.index + i) % len(cs.list)
+		if cs.list[next].Policy.Backoff() == 0 {
+			cs.index = next
+			break
+		}
+	}
+	to := cs.list[cs.index].URL
+	cs.lock.Unlock()
+
+	if from != to {
+		log.Errorf("Failing over from %s to %s", from, to)
+		RestartStream(cs)
+	}
+}
+
+// StartControllerProbe periodically checks whether a controller earlier in a
+// list is healthy again, and if so switches back to it
+func StartControllerProbe(ctx context.Context) error {
+	for {
+		if !sleepContext(ctx, time.Duration(config.FailbackInterval)*time.Second) {
+			return nil
+		}
+
+		for _, id := range Identities() {
+			id.Controllers().probe(id)
+		}
+	}
+}
+
+func (cs *ControllerSet) probe(id *Identity) {
+	cs.lock.Lock()
+	candidates := make([]*Controller, cs.index)
+	copy(candidates, cs.list[:cs.index])
+	cs.lock.Unlock()
+
+	for i, ctl := range candidates {
+		err := ProbeController(ctl, id)
+		if err != nil {
+			log.Infof("Controller %s is still unavailable: %v", ctl.URL, err)
+			continue
+		}
+		ctl.Policy.Success()
+
+		cs.lock.Lock()
+		from := cs.list[cs.index].URL
+		if i < len(cs.list) && cs.list[i] == ctl {
+			cs.index = i
+		}
+		cs.lock.Unlock()
+
+		log.Infof("Controller %s is available, switching back from %s", ctl.URL, from)
+		RestartStream(cs)
+		break
+	}
+}
+
+// ProbeController makes a single request to see if a controller is up
+func ProbeController(ctl *Controller, id *Identity) error {
+	client, err := HTTPClient()
+	if err != nil {
+		return err
+	}
+
+	var reqURL string = fmt.Sprintf(meshifyHostAPIFmt, ctl.URL, id.HostID)
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", id.ApiKey)
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return NewAPIError(resp)
+	}
+	return nil
+}
+
+// Status returns the retry state of every controller in the set
+func (cs *ControllerSet) Status() []RetryStatus {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	status := make([]RetryStatus, 0, len(cs.list))
+	for i, ctl := range cs.list {
+		s := ctl.Policy.Status()
+		s.Active = i == cs.index
+		status = append(status, s)
+	}
+	return status
+}
+
+// ControllerStatus returns the retry state of every configured controller
+func ControllerStatus() []RetryStatus {
+	status := Controllers.Status()
+	for _, id := range config.Identities {
+		if id.controllers != nil {
+			status = append(status, id.controllers.Status()...)
+		}
+	}
+	return status
+}
+
+// splitHosts parses a comma separated list of controller URLs
+func splitHosts(list string) []string {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(list, ",") {
+		host = strings.TrimRight(strings.TrimSpace(host), "/")
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -24,36 +22,32 @@ var (
 	DnsLock     sync.Mutex
 )
 
-func StartDNS() error {
+// dnsServers are the listeners we have started, by address
+var (
+	dnsServers     = make(map[string]*dns.Server)
+	dnsServersLock sync.Mutex
+)
+
+func StartDNS(ctx context.Context) error {
 	ServerTable = make(map[string]string)
 	DnsTable = make(map[string][]string)
 
 	dns.HandleFunc(".", handleQueries)
 
-	var conf []byte
+	// wait for the config of at least one identity
+	var msg model.Message
 	for exists := false; !exists; {
-		file, err := os.Open(GetDataPath() + "meshify.conf")
-		if err != nil {
-			time.Sleep(time.Second)
-		} else {
-			conf, err = ioutil.ReadAll(file)
-			file.Close()
-			if err != nil {
-				log.Errorf("Error reading meshify config file: %v", err)
-				time.Sleep(time.Second)
-			} else {
-				exists = true
+		var err error
+		msg, err = LoadMessages()
+		if err != nil || len(Identities()) == 0 {
+			if !sleepContext(ctx, time.Second) {
+				return nil
 			}
+		} else {
+			exists = true
 		}
 	}
 
-	var msg model.Message
-	err := json.Unmarshal(conf, &msg)
-	if err != nil {
-		log.Errorf("Error reading message from config file")
-		return err
-	}
-
 	ServerLock.Lock()
 	defer ServerLock.Unlock()
 
@@ -63,7 +57,7 @@ func StartDNS() error {
 	for i := 0; i < len(msg.Config); i++ {
 		index := -1
 		for j := 0; j < len(msg.Config[i].Hosts); j++ {
-			if msg.Config[i].Hosts[j].HostGroup == config.HostID {
+			if IsSelf(msg.Config[i].Hosts[j]) {
 				index = j
 				break
 			}
@@ -112,13 +106,7 @@ func StartDNS() error {
 
 				if len(host.Current.Address[0]) > 3 {
 					address := host.Current.Address[0][:len(host.Current.Address[0])-3] + ":53"
-					server := &dns.Server{Addr: address, Net: "udp", TsigSecret: nil, ReusePort: true}
-					log.Infof("Starting DNS Server on %s", address)
-					go func() {
-						if err := server.ListenAndServe(); err != nil {
-							log.Errorf("Failed to setup the DNS server on %s: %s\n", address, err.Error())
-						}
-					}()
+					startDNSServer(ctx, address)
 				}
 			}
 		}
@@ -127,22 +115,88 @@ func StartDNS() error {
 	return nil
 }
 
+// startDNSServer listens on address unless we already are
+func startDNSServer(ctx context.Context, address string) {
+	dnsServersLock.Lock()
+	defer dnsServersLock.Unlock()
+
+	if _, found := dnsServers[address]; found || ctx.Err() != nil {
+		return
+	}
+
+	server := &dns.Server{Addr: address, Net: "udp", TsigSecret: nil, ReusePort: true}
+	dnsServers[address] = server
+	log.Infof("Starting DNS Server on %s", address)
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Errorf("Failed to setup the DNS server on %s: %s\n", address, err.Error())
+		}
+		// let the next StartDNS try again
+		dnsServersLock.Lock()
+		if dnsServers[address] == server {
+			delete(dnsServers, address)
+		}
+		dnsServersLock.Unlock()
+	}()
+}
+
+// StopDNS closes every DNS listener
+func StopDNS(ctx context.Context) error {
+	dnsServersLock.Lock()
+	servers := make([]*dns.Server, 0, len(dnsServers))
+	for address, server := range dnsServers {
+		servers = append(servers, server)
+		delete(dnsServers, address)
+	}
+	dnsServersLock.Unlock()
+
+	var lastErr error
+	for _, server := range servers {
+		err := server.ShutdownContext(ctx)
+		if err != nil {
+			log.Errorf("Error stopping DNS server on %s: %v", server.Addr, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 func UpdateDNS(msg model.Message) error {
 
+	dnsTable, serverTable, err := BuildDNSTables(msg)
+	if err != nil {
+		return err
+	}
+
+	DnsLock.Lock()
+	DnsTable = dnsTable
+	DnsLock.Unlock()
+
+	ServerLock.Lock()
+	ServerTable = serverTable
+	ServerLock.Unlock()
+
+	return nil
+}
+
+// BuildDNSTables works out the names served for the meshes of a message, and
+// the servers queries for other names are forwarded to
+func BuildDNSTables(msg model.Message) (map[string][]string, map[string]string, error) {
+
 	serverTable := make(map[string]string)
 	dnsTable := make(map[string][]string)
 
 	for i := 0; i < len(msg.Config); i++ {
 		index := -1
 		for j := 0; j < len(msg.Config[i].Hosts); j++ {
-			if msg.Config[i].Hosts[j].HostGroup == config.HostID {
+			if IsSelf(msg.Config[i].Hosts[j]) {
 				index = j
 				break
 			}
 		}
 		if index == -1 {
 			log.Errorf("Error reading message for DNS update: %v", msg)
-			return errors.New("Error reading message")
+			return nil, nil, errors.New("Error reading message")
 		} else {
 			if msg.Config[i].Hosts[index].Enable && msg.Config[i].Hosts[index].Current.EnableDns {
 				host := msg.Config[i].Hosts[index]
@@ -161,22 +215,25 @@ func UpdateDNS(msg model.Message) error {
 
 				}
 				dnsTable[name] = append(dnsTable[name], host.Current.Address...)
-				msg.Config[i].Hosts = append(msg.Config[i].Hosts[:index], msg.Config[i].Hosts[index+1:]...)
-				for j := 0; j < len(msg.Config[i].Hosts); j++ {
-					n := strings.ToLower(msg.Config[i].Hosts[j].Name)
-					if strings.Contains(msg.Config[i].Hosts[j].Current.Address[0], ":") {
+				// the message is shared with the caller, so leave its hosts alone
+				hosts := make([]model.Host, 0, len(msg.Config[i].Hosts)-1)
+				hosts = append(hosts, msg.Config[i].Hosts[:index]...)
+				hosts = append(hosts, msg.Config[i].Hosts[index+1:]...)
+				for j := 0; j < len(hosts); j++ {
+					n := strings.ToLower(hosts[j].Name)
+					if strings.Contains(hosts[j].Current.Address[0], ":") {
 						// ipv6
 					} else {
 						// ipv4
-						addresses := strings.Split(msg.Config[i].Hosts[j].Current.Address[0], "/")
+						addresses := strings.Split(hosts[j].Current.Address[0], "/")
 						address := addresses[0]
 						digits := strings.Split(address, ".")
 						label := fmt.Sprintf("%s.%s.%s.%s.in-addr.arpa", digits[3], digits[2], digits[1], digits[0])
 						dnsTable[label] = []string{n}
 					}
-					dnsTable[n] = append(dnsTable[n], msg.Config[i].Hosts[j].Current.Address...)
-					if msg.Config[i].Hosts[j].Current.Endpoint != "" {
-						ip_port := msg.Config[i].Hosts[j].Current.Endpoint
+					dnsTable[n] = append(dnsTable[n], hosts[j].Current.Address...)
+					if hosts[j].Current.Endpoint != "" {
+						ip_port := hosts[j].Current.Endpoint
 						parts := strings.Split(ip_port, ":")
 						ip := parts[0]
 						serverTable[ip] = ip
@@ -185,15 +242,8 @@ func UpdateDNS(msg model.Message) error {
 			}
 		}
 	}
-	DnsLock.Lock()
-	DnsTable = dnsTable
-	DnsLock.Unlock()
 
-	ServerLock.Lock()
-	ServerTable = serverTable
-	ServerLock.Unlock()
-
-	return nil
+	return dnsTable, serverTable, nil
 }
 
 func handleQueries(w dns.ResponseWriter, r *dns.Msg) {
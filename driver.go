@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// Driver manages the wireguard interfaces of the meshes.  Each platform
+// registers the drivers it has and config.WireguardDriver picks one.
+type Driver interface {
+	// Up creates the interface of a mesh from its config in wg-quick format,
+	// which has already been written to GetWireguardPath()
+	Up(meshName string, conf []byte) error
+
+	// Down removes the interface of a mesh
+	Down(meshName string) error
+
+	// ApplyPeers changes the peers of a running mesh without restarting it
+	ApplyPeers(meshName string, changes *PeerChanges) error
+
+	// Stats returns the transfer of each peer as "wg show <mesh> transfer" does
+	Stats(meshName string) (string, error)
+
+	// Interfaces lists the meshes that are up
+	Interfaces() ([]string, error)
+}
+
+// drivers are the registered drivers by name.  driver, when set, is used
+// instead of the one in the config.
+var (
+	drivers    = make(map[string]Driver)
+	driver     Driver
+	driverLock sync.Mutex
+)
+
+// RegisterDriver makes a driver available to config.WireguardDriver
+func RegisterDriver(name string, d Driver) {
+	driverLock.Lock()
+	defer driverLock.Unlock()
+
+	drivers[name] = d
+}
+
+// SetDriver replaces the configured driver, such as with a FakeDriver.  nil
+// goes back to the configured one.
+func SetDriver(d Driver) {
+	driverLock.Lock()
+	defer driverLock.Unlock()
+
+	driver = d
+}
+
+// CurrentDriver is the driver the meshes are managed with
+func CurrentDriver() Driver {
+	driverLock.Lock()
+	defer driverLock.Unlock()
+
+	if driver != nil {
+		return driver
+	}
+	name := config.WireguardDriver
+	if name == "" {
+		name = defaultDriver
+	}
+	d, found := drivers[name]
+	if !found {
+		log.Errorf("Unknown wireguard driver %s, using %s", name, defaultDriver)
+		d = drivers[defaultDriver]
+	}
+	return d
+}
+
+// DriverNames lists the drivers available on this platform
+func DriverNames() []string {
+	driverLock.Lock()
+	defer driverLock.Unlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartWireguard brings up a mesh from its config file
+func StartWireguard(meshName string) error {
+	path := GetWireguardPath() + meshName + ".conf"
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = CurrentDriver().Up(meshName, conf)
+	if err != nil {
+		log.Errorf("Error starting WireGuard: %v", err)
+	}
+	return err
+}
+
+// StopWireguard brings down a mesh and removes its config file
+func StopWireguard(meshName string) error {
+	err := CurrentDriver().Down(meshName)
+	if err != nil {
+		log.Errorf("Error stopping WireGuard: %v", err)
+	}
+
+	// remove the file if it exists
+	path := GetWireguardPath() + meshName + ".conf"
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+// GetStats returns the transfer of each peer of a mesh
+func GetStats(mesh string) (string, error) {
+	out, err := CurrentDriver().Stats(mesh)
+	if err != nil {
+		log.Errorf("Error getting statistics: %v", err)
+	}
+	return out, err
+}
+
+// wgctrlStats formats the transfer of each peer like "wg show <mesh> transfer"
+func wgctrlStats(meshName string) (string, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return "", err
+	}
+	defer wg.Close()
+
+	device, err := wg.Device(meshName)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for _, peer := range device.Peers {
+		fmt.Fprintf(&out, "%s\t%d\t%d\n", peer.PublicKey, peer.ReceiveBytes, peer.TransmitBytes)
+	}
+	return out.String(), nil
+}
+
+// wgctrlInterfaces lists the wireguard devices wgctrl can see
+func wgctrlInterfaces() ([]string, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wg.Close()
+
+	devices, err := wg.Devices()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(devices))
+	for _, device := range devices {
+		names = append(names, device.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExitNodeConfig is the local setting that sends all traffic of this host
+// through a peer of a mesh.  LAN access stays direct unless BlockLAN is set.
+type ExitNodeConfig struct {
+	Peer       string // name or public key of the peer
+	BlockLAN   bool
+	KillSwitch bool
+}
+
+// ExitNode is an exit node setting resolved against the mesh
+type ExitNode struct {
+	Peer       string   `json:"peer"`
+	Endpoint   string   `json:"endpoint"`
+	BlockLAN   bool     `json:"blockLAN"`
+	KillSwitch bool     `json:"killSwitch"`
+	LAN        []string `json:"lan"`
+}
+
+// The default routes that go to an exit node
+var defaultRoutes = []string{"0.0.0.0/0", "::/0"}
+
+// exitNodes is what SetExitNode was last called with for each mesh
+var (
+	exitNodes    = make(map[string]string)
+	exitNodeLock sync.Mutex
+)
+
+// useExitNode routes everything through the exit node peer of a mesh, if one
+// is configured, by adding the default routes to its AllowedIPs.  The drivers
+// turn those into policy routing that keeps the endpoints reachable.
+func useExitNode(meshName string, peers []model.Host, lan []string) (*ExitNode, error) {
+	c, found := config.UseExitNode[meshName]
+	if !found {
+		return nil, nil
+	}
+	if c.Peer == "" {
+		return nil, fmt.Errorf("no exit node peer set for %s", meshName)
+	}
+
+	for i := range peers {
+		p := &peers[i]
+		if p.Name != c.Peer && p.Current.PublicKey != c.Peer {
+			continue
+		}
+		if !p.Enable {
+			return nil, fmt.Errorf("exit node %s is disabled", c.Peer)
+		}
+		if p.Current.Endpoint == "" {
+			return nil, fmt.Errorf("exit node %s has no endpoint", c.Peer)
+		}
+		p.Current.AllowedIPs = append(p.Current.AllowedIPs, defaultRoutes...)
+		return &ExitNode{
+			Peer:       p.Current.PublicKey,
+			Endpoint:   p.Current.Endpoint,
+			BlockLAN:   c.BlockLAN,
+			KillSwitch: c.KillSwitch,
+			LAN:        lan,
+		}, nil
+	}
+	return nil, fmt.Errorf("exit node %s is not a peer of %s", c.Peer, meshName)
+}
+
+func exitNodeSignature(exit *ExitNode) string {
+	if exit == nil {
+		return ""
+	}
+	data, _ := json.Marshal(exit)
+	return string(data)
+}
+
+// exitNodeChanged is true if SetExitNode needs calling for a mesh
+func exitNodeChanged(meshName string, exit *ExitNode) bool {
+	exitNodeLock.Lock()
+	defer exitNodeLock.Unlock()
+
+	return exitNodes[meshName] != exitNodeSignature(exit)
+}
+
+// applyExitNode sets up the LAN rules and kill switch of an exit node, or
+// removes them for nil
+func applyExitNode(meshName string, exit *ExitNode) error {
+	err := SetExitNode(meshName, exit)
+	if err != nil {
+		return err
+	}
+
+	exitNodeLock.Lock()
+	defer exitNodeLock.Unlock()
+	if exit == nil {
+		delete(exitNodes, meshName)
+	} else {
+		exitNodes[meshName] = exitNodeSignature(exit)
+	}
+	return nil
+}
+
+// stopExitNode is called for a mesh that is going down or away
+func stopExitNode(meshName string) {
+	err := applyExitNode(meshName, nil)
+	if err != nil {
+		log.Errorf("Error removing the exit node rules of %s: %v", meshName, err)
+	}
+}
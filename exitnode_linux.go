@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// lanRuleTables are the routing tables the LAN rules of each mesh point at,
+// so they can be found again once the interface is gone
+var (
+	lanRuleTables = make(map[string]int)
+	lanRuleLock   sync.Mutex
+)
+
+// SetExitNode adds what the default routes through an exit node don't do on
+// their own.  With BlockLAN the local subnets are sent through the tunnel
+// too, ahead of the rule that lets the main table route them.  The kill
+// switch is an nftables table that rejects anything leaving outside the
+// tunnel, other than wireguard itself.  nil removes both.
+func SetExitNode(meshName string, exit *ExitNode) error {
+	lanRuleLock.Lock()
+	defer lanRuleLock.Unlock()
+
+	if table, found := lanRuleTables[meshName]; found {
+		deleteLANRules(table)
+		delete(lanRuleTables, meshName)
+	}
+
+	table := meshFirewallMark(meshName)
+	if exit != nil && exit.BlockLAN && table != 0 {
+		lanRuleTables[meshName] = table
+		for _, cidr := range exit.LAN {
+			err := addLANRule(cidr, table)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if exit == nil || !exit.KillSwitch {
+		return removeKillSwitch(meshName)
+	}
+	return installKillSwitch(meshName, exit, table)
+}
+
+// meshFirewallMark is the fwmark of a mesh, which the drivers set to the
+// table of its default route
+func meshFirewallMark(meshName string) int {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return 0
+	}
+	defer wg.Close()
+
+	device, err := wg.Device(meshName)
+	if err != nil {
+		return 0
+	}
+	return device.FirewallMark
+}
+
+func addLANRule(cidr string, table int) error {
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	rule := netlink.NewRule()
+	rule.Dst = dst
+	rule.Family = netlink.FAMILY_V4
+	if dst.IP.To4() == nil {
+		rule.Family = netlink.FAMILY_V6
+	}
+	rule.Table = table
+	rule.Mark = table
+	rule.Invert = true
+	err = netlink.RuleAdd(rule)
+	if err != nil {
+		return fmt.Errorf("error adding rule for %s: %v", cidr, err)
+	}
+	return nil
+}
+
+// deleteLANRules removes the rules added by addLANRule for a table
+func deleteLANRules(table int) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.Dst != nil && rule.Table == table && rule.Mark == table && rule.Invert {
+				r := rule
+				r.Family = family
+				netlink.RuleDel(&r)
+			}
+		}
+	}
+}
+
+// killSwitchTable is the nftables table of the kill switch of a mesh
+func killSwitchTable(meshName string) string {
+	return "meshify-killswitch-" + meshName
+}
+
+func installKillSwitch(meshName string, exit *ExitNode, mark int) error {
+	table := killSwitchTable(meshName)
+	var script bytes.Buffer
+
+	// creating the table first makes the delete safe when there is none, so
+	// the whole table is replaced in one transaction
+	fmt.Fprintf(&script, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&script, "table inet %s {\n\tchain output {\n", table)
+	fmt.Fprintf(&script, "\t\ttype filter hook output priority 0; policy accept;\n")
+	fmt.Fprintf(&script, "\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&script, "\t\toifname \"%s\" accept\n", meshName)
+
+	// wireguard's own packets, which are marked when the default route is
+	// policy routed, otherwise those to the endpoint of the exit node
+	if mark != 0 {
+		fmt.Fprintf(&script, "\t\tmeta mark %d accept\n", mark)
+	} else if addr, err := net.ResolveUDPAddr("udp", exit.Endpoint); err == nil {
+		family := "ip"
+		if addr.IP.To4() == nil {
+			family = "ip6"
+		}
+		fmt.Fprintf(&script, "\t\t%s daddr %s udp dport %d accept\n", family, addr.IP, addr.Port)
+	}
+
+	if !exit.BlockLAN {
+		v4 := make([]string, 0)
+		v6 := make([]string, 0)
+		for _, cidr := range exit.LAN {
+			if p, err := netip.ParsePrefix(cidr); err == nil {
+				if p.Addr().Is4() {
+					v4 = append(v4, cidr)
+				} else {
+					v6 = append(v6, cidr)
+				}
+			}
+		}
+		if len(v4) > 0 {
+			fmt.Fprintf(&script, "\t\tip daddr { %s } accept\n", strings.Join(v4, ", "))
+		}
+		if len(v6) > 0 {
+			fmt.Fprintf(&script, "\t\tip6 daddr { %s } accept\n", strings.Join(v6, ", "))
+		}
+	}
+
+	// DHCP and neighbor discovery, without which the LAN link itself fails
+	fmt.Fprintf(&script, "\t\tudp sport 68 udp dport 67 accept\n")
+	fmt.Fprintf(&script, "\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	fmt.Fprintf(&script, "\t\treject\n\t}\n}\n")
+
+	return nft(script.String())
+}
+
+func removeKillSwitch(meshName string) error {
+	table := killSwitchTable(meshName)
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil
+	}
+	return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", table, table))
+}
+
+// nft runs an nftables script
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("nft: %v (%s)", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
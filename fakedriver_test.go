@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeDriver keeps the meshes in memory instead of creating interfaces, so
+// the reconciler can be run without root.  Install it with SetDriver, then
+// look at Interfaces, Peers and Calls to see what the reconciler did.
+type FakeDriver struct {
+	lock   sync.Mutex
+	meshes map[string]*wgQuickConfig
+	calls  []string
+}
+
+// NewFakeDriver returns a FakeDriver with no meshes up
+func NewFakeDriver() *FakeDriver {
+	return &FakeDriver{meshes: make(map[string]*wgQuickConfig)}
+}
+
+func (f *FakeDriver) Up(meshName string, conf []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls = append(f.calls, "up "+meshName)
+	if _, found := f.meshes[meshName]; found {
+		return fmt.Errorf("%s already exists", meshName)
+	}
+	c, err := parseWireguardConfig(conf)
+	if err != nil {
+		return err
+	}
+	f.meshes[meshName] = c
+	return nil
+}
+
+func (f *FakeDriver) Down(meshName string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls = append(f.calls, "down "+meshName)
+	if _, found := f.meshes[meshName]; !found {
+		return fmt.Errorf("%s is not running", meshName)
+	}
+	delete(f.meshes, meshName)
+	return nil
+}
+
+func (f *FakeDriver) ApplyPeers(meshName string, changes *PeerChanges) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls = append(f.calls, "peers "+meshName)
+	if _, found := f.meshes[meshName]; !found {
+		return fmt.Errorf("%s is not running", meshName)
+	}
+	f.meshes[meshName] = changes.desired
+	return nil
+}
+
+// Stats reports no transfer for every peer
+func (f *FakeDriver) Stats(meshName string) (string, error) {
+	var out strings.Builder
+	for _, key := range f.Peers(meshName) {
+		fmt.Fprintf(&out, "%s\t0\t0\n", key)
+	}
+	return out.String(), nil
+}
+
+func (f *FakeDriver) Interfaces() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	names := make([]string, 0, len(f.meshes))
+	for name := range f.meshes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Peers lists the public keys of the peers of a mesh that is up
+func (f *FakeDriver) Peers(meshName string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	keys := make([]string, 0)
+	if c, found := f.meshes[meshName]; found {
+		for key := range c.Peers {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AllowedIPs lists the allowed IPs of a peer of a mesh that is up
+func (f *FakeDriver) AllowedIPs(meshName string, publicKey string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if c, found := f.meshes[meshName]; found {
+		if peer, found := c.Peers[publicKey]; found {
+			return peer.allowedIPs()
+		}
+	}
+	return nil
+}
+
+// Calls lists what the driver was asked to do, such as "up mesh1", in order
+func (f *FakeDriver) Calls() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.calls...)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// firewallTable is the nftables table of the firewall of a mesh
+func firewallTable(meshName string) string {
+	return "meshify-acl-" + meshName
+}
+
+// unknownSignature stands for a table left by a previous run, which matches
+// no config
+const unknownSignature = "?"
+
+// adoptTables takes over the tables a previous run of the agent left behind,
+// since what it applied is only kept in memory.  The tables of meshes that
+// are not wanted are deleted.  Those of the others are recorded as matching
+// no config, so Plan replaces or removes them.
+func adoptTables(desired []*DesiredMesh) error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("nft", "list", "tables", "inet")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("nft: %v (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	wanted := make(map[string]bool)
+	for _, d := range desired {
+		wanted[d.MeshName] = true
+	}
+	kinds := []struct {
+		prefix string
+		lock   *sync.Mutex
+		state  *map[string]string
+	}{
+		{firewallTable(""), &firewallLock, &firewalls},
+		{routingTable(""), &routingLock, &routing},
+		{killSwitchTable(""), &exitNodeLock, &exitNodes},
+	}
+
+	var lastErr error
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "table" || fields[1] != "inet" {
+			continue
+		}
+		table := fields[2]
+		for _, kind := range kinds {
+			if !strings.HasPrefix(table, kind.prefix) {
+				continue
+			}
+			meshName := strings.TrimPrefix(table, kind.prefix)
+			if !wanted[meshName] {
+				log.Infof("Deleting table %s, %s is not wanted", table, meshName)
+				err := nft(fmt.Sprintf("delete table inet %s\n", table))
+				if err != nil {
+					lastErr = err
+				}
+				continue
+			}
+
+			kind.lock.Lock()
+			if _, found := (*kind.state)[meshName]; !found {
+				(*kind.state)[meshName] = unknownSignature
+			}
+			kind.lock.Unlock()
+		}
+	}
+	return lastErr
+}
+
+// SetFirewall replaces the nftables table that filters what comes in on the
+// mesh interface.  Replies and anything an ACL allows are accepted and the
+// rest dropped.  The table is replaced in one transaction, so there is no
+// moment without rules.  nil removes the table.
+func SetFirewall(meshName string, acls []ACL) error {
+	table := firewallTable(meshName)
+	if acls == nil {
+		if _, err := exec.LookPath("nft"); err != nil {
+			return nil
+		}
+		return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", table, table))
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&script, "table inet %s {\n\tchain input {\n", table)
+	fmt.Fprintf(&script, "\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tiifname != \"%s\" accept\n", meshName)
+	fmt.Fprintf(&script, "\t\tct state established,related accept\n")
+	for _, acl := range acls {
+		for _, family := range []string{"ip", "ip6"} {
+			sources := make([]string, 0, len(acl.Sources))
+			for _, cidr := range acl.Sources {
+				if p, err := netip.ParsePrefix(cidr); err == nil && p.Addr().Is4() == (family == "ip") {
+					sources = append(sources, cidr)
+				}
+			}
+			if len(sources) == 0 {
+				continue
+			}
+			match := fmt.Sprintf("%s saddr { %s }", family, strings.Join(sources, ", "))
+			for _, rule := range aclMatches(acl, family) {
+				fmt.Fprintf(&script, "\t\t%s accept\n", strings.TrimSpace(match+" "+rule))
+			}
+		}
+	}
+	fmt.Fprintf(&script, "\t\tdrop\n\t}\n}\n")
+
+	return nft(script.String())
+}
+
+// aclMatches is the protocol and port part of the rules for an ACL
+func aclMatches(acl ACL, family string) []string {
+	ports := ""
+	if len(acl.Ports) > 0 {
+		ports = " dport { " + strings.Join(acl.Ports, ", ") + " }"
+	}
+	switch acl.Protocol {
+	case "icmp":
+		if family == "ip" {
+			return []string{"meta l4proto icmp"}
+		}
+		return []string{"meta l4proto icmpv6"}
+	case "tcp", "udp":
+		if ports == "" {
+			return []string{"meta l4proto " + acl.Protocol}
+		}
+		return []string{acl.Protocol + ports}
+	}
+	if ports == "" {
+		return []string{""}
+	}
+	return []string{"tcp" + ports, "udp" + ports}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// HistoryEntry is one message from meshify as it was received
+type HistoryEntry struct {
+	Time     time.Time       `json:"time"`
+	ETag     string          `json:"etag"`
+	Identity string          `json:"identity"`
+	Message  json.RawMessage `json:"message"`
+	Pinned   bool            `json:"pinned,omitempty"`
+}
+
+// Pin is a message restored by a local rollback.  It is kept until meshify
+// sends a different message or the pin is removed.
+type Pin struct {
+	Time     time.Time `json:"time"`
+	PinnedAt time.Time `json:"pinnedAt"`
+}
+
+// HistoryPath is where the messages of this identity are kept, one file each
+func (id *Identity) HistoryPath() string {
+	sep := string(os.PathSeparator)
+	return GetDataPath() + "history" + sep + id.String() + sep
+}
+
+// RecordHistory saves a message from meshify, keeping the last config.HistorySize
+func RecordHistory(id *Identity, body []byte, etag string) error {
+	if config.HistorySize <= 0 {
+		return nil
+	}
+
+	path := id.HistoryPath()
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return err
+	}
+
+	var compact bytes.Buffer
+	err = json.Compact(&compact, body)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entry := HistoryEntry{Time: now, ETag: etag, Identity: id.String(), Message: compact.Bytes()}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path+strconv.FormatInt(now.UnixNano(), 10)+".json", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	files, err := historyFiles(id)
+	if err != nil {
+		return err
+	}
+	for i := config.HistorySize; i < len(files); i++ {
+		os.Remove(path + files[i])
+	}
+	return nil
+}
+
+// historyFiles lists the entries of an identity, newest first
+func historyFiles(id *Identity) ([]string, error) {
+	infos, err := ioutil.ReadDir(id.HistoryPath())
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, ".json") && name != "pinned.json" {
+			files = append(files, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files, nil
+}
+
+// LoadHistory reads the entries of an identity, newest first
+func LoadHistory(id *Identity) ([]HistoryEntry, error) {
+	files, err := historyFiles(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []HistoryEntry{}, nil
+		}
+		return nil, err
+	}
+
+	pin := id.Pin()
+	entries := make([]HistoryEntry, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(id.HistoryPath() + file)
+		if err != nil {
+			continue
+		}
+		var entry HistoryEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			log.Errorf("Error reading history entry %s: %v", file, err)
+			continue
+		}
+		entry.Pinned = pin != nil && pin.Time.Equal(entry.Time)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// History is the entries of every identity, newest first
+func History() ([]HistoryEntry, error) {
+	all := make([]HistoryEntry, 0)
+	for _, id := range Identities() {
+		entries, err := LoadHistory(id)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.After(all[j].Time)
+	})
+	return all, nil
+}
+
+// Pin returns the pin on this identity, or nil
+func (id *Identity) Pin() *Pin {
+	data, err := ioutil.ReadFile(id.HistoryPath() + "pinned.json")
+	if err != nil {
+		return nil
+	}
+	var pin Pin
+	err = json.Unmarshal(data, &pin)
+	if err != nil {
+		return nil
+	}
+	return &pin
+}
+
+// KeepPin is called with each new message from meshify.  It returns true if
+// the identity is pinned and meshify has sent nothing new since, otherwise it
+// removes the pin.
+func (id *Identity) KeepPin(body []byte) bool {
+	if id.Pin() == nil {
+		return false
+	}
+
+	entries, err := LoadHistory(id)
+	if err == nil && len(entries) > 0 && sameMessage(entries[0].Message, body) {
+		return true
+	}
+
+	log.Infof("Meshify sent a new config for %s, removing the pin", id)
+	os.Remove(id.HistoryPath() + "pinned.json")
+	return false
+}
+
+func sameMessage(a []byte, b []byte) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// RollbackHistory applies the nth entry of History, counting from 1, and pins
+// it until meshify sends a new config or Unpin is called
+func RollbackHistory(n int) (HistoryEntry, error) {
+	entries, err := History()
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	if n < 1 || n > len(entries) {
+		return HistoryEntry{}, fmt.Errorf("no history entry %d, there are %d", n, len(entries))
+	}
+	entry := entries[n-1]
+
+	var id *Identity
+	for _, i := range Identities() {
+		if i.String() == entry.Identity {
+			id = i
+		}
+	}
+	if id == nil {
+		return entry, fmt.Errorf("identity %s no longer exists", entry.Identity)
+	}
+
+	pin := Pin{Time: entry.Time, PinnedAt: time.Now()}
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return entry, err
+	}
+	err = writeFileAtomic(id.HistoryPath()+"pinned.json", data, 0600)
+	if err != nil {
+		return entry, err
+	}
+
+	log.Infof("Rolling %s back to the config of %s", id, entry.Time.Format(time.RFC3339))
+	err = restoreMessage(id, entry.Message, "rollback")
+	return entry, err
+}
+
+// Unpin removes the pins of every identity and applies the newest message from meshify
+func Unpin() error {
+	for _, id := range Identities() {
+		if id.Pin() == nil {
+			continue
+		}
+		err := os.Remove(id.HistoryPath() + "pinned.json")
+		if err != nil {
+			return err
+		}
+
+		entries, err := LoadHistory(id)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		log.Infof("Unpinned %s, applying the newest config", id)
+		err = restoreMessage(id, entries[0].Message, "unpin")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreMessage makes an earlier message the config of an identity and applies it
+func restoreMessage(id *Identity, message []byte, reason string) error {
+	var msg model.Message
+	err := json.Unmarshal(message, &msg)
+	if err != nil {
+		return err
+	}
+
+	var oldconf model.Message
+	conf, err := ioutil.ReadFile(id.ConfPath())
+	if err == nil {
+		json.Unmarshal(conf, &oldconf)
+	}
+
+	err = writeFileAtomic(id.ConfPath(), message, 0600)
+	if err != nil {
+		return err
+	}
+
+	msg2, err := LoadMessages()
+	if err == nil {
+		err = UpdateDNS(msg2)
+	}
+	if err != nil {
+		log.Errorf("Error updating DNS configuration: %v", err)
+	}
+
+	// meshes that are in the old message and not this one get deleted
+	RememberMeshes(id, oldconf)
+	_, err = Reconcile(context.Background(), reason+" for "+id.String())
+	return err
+}
+
+// HistoryCommand handles the history, rollback and unpin commands.  Rollback
+// and unpin are done by the running agent if there is one.
+//
+//	meshify-client history
+//	meshify-client rollback <n>
+//	meshify-client unpin
+func HistoryCommand(cmd string, args []string) error {
+	switch cmd {
+	case "history":
+		entries, err := History()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			fmt.Println("No history")
+		}
+		for i, entry := range entries {
+			var msg model.Message
+			json.Unmarshal(entry.Message, &msg)
+			meshes := make([]string, 0, len(msg.Config))
+			for _, mesh := range msg.Config {
+				meshes = append(meshes, mesh.MeshName)
+			}
+			pinned := ""
+			if entry.Pinned {
+				pinned = " (pinned)"
+			}
+			fmt.Printf("%3d  %s  %-10s %-20s %s%s\n", i+1, entry.Time.Format("2006-01-02 15:04:05"), entry.Identity, entry.ETag, strings.Join(meshes, ","), pinned)
+		}
+		return nil
+
+	case "rollback":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: meshify-client rollback <n>")
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("usage: meshify-client rollback <n>")
+		}
+		if reached, err := localAPI("/history/rollback/" + args[0]); reached {
+			return err
+		}
+		_, err = RollbackHistory(n)
+		return err
+
+	case "unpin":
+		if reached, err := localAPI("/history/unpin"); reached {
+			return err
+		}
+		return Unpin()
+	}
+
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+// localAPI posts to the local API of a running agent.  reached is false if
+// there is no agent running.
+func localAPI(path string) (reached bool, err error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Post("http://127.0.0.1:53280"+path, "application/json", nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return true, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return true, nil
+}
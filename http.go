@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -93,7 +95,8 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 
 // keyHandler will generate a new keypair and insert it into the keystore.
 // It will then return the public key.  This allows the agent to create a new
-// host without compromising the private key.
+// host without compromising the private key.  The key goes in the store of the
+// identity named by ?identity=, or the default identity.
 func keyHandler(w http.ResponseWriter, req *http.Request) {
 	log.Infof("keyHandler")
 	// /keys/
@@ -105,11 +108,19 @@ func keyHandler(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		log.Infof("Method: %s", req.Method)
+		id := defaultIdentity
+		if name := req.URL.Query().Get("identity"); name != "" {
+			for _, i := range config.Identities {
+				if i.Name == name {
+					id = i
+				}
+			}
+		}
 		key := Key{}
 		wg, _ := wgtypes.GeneratePrivateKey()
 		key.Public = wg.PublicKey().String()
-		KeyAdd(key.Public, wg.String())
-		KeySave()
+		KeyAdd(id, key.Public, wg.String())
+		KeySave(id)
 		json.NewEncoder(w).Encode(key)
 
 	default:
@@ -150,16 +161,144 @@ func stopServiceHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func startHTTPd() {
-	http.HandleFunc("/stats/", statsHandler)
-	http.HandleFunc("/keys/", keyHandler)
-	http.HandleFunc("/service/", stopServiceHandler)
+// controlPlaneHandler returns the backoff and circuit breaker state for calls to meshify
+func controlPlaneHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
 
-	log.Infof("Starting web server on %s", ":53280")
+	status := append(ControllerStatus(), hostPolicy.Status(), servicePolicy.Status())
+	json.NewEncoder(w).Encode(status)
+}
+
+// statusHandler returns the status reported in the heartbeat for every mesh
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
 
-	err := http.ListenAndServe(":53280", nil)
+	status, err := BuildStatus()
 	if err != nil {
 		log.Error(err)
+		status = make([]HostStatus, 0)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// reconcileHandler applies the last config from meshify again and returns
+// what it did.  It runs under ctx, the agent's, so shutting down stops it but
+// a client that goes away does not.
+func reconcileHandler(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			actions, err := Reconcile(ctx, "local API")
+			if err != nil {
+				log.Error(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(actions)
+
+		default:
+			io.WriteString(w, "")
+			log.Infof("Unknown method: %s", req.Method)
+		}
+	}
+}
+
+// appliedHandler returns what the agent has set up besides wireguard, for
+// meshify-client plan
+func appliedHandler(w http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(w).Encode(CurrentAppliedState())
+}
+
+// localOnly serves a handler only to the command line on this host.  A
+// request from another host is refused, and so is one with an Origin, which
+// a web page in a browser here would send.
+func localOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() || req.Header.Get("Origin") != "" {
+			log.Errorf("Refused %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// historyHandler lists the messages from meshify, and rolls back to one of
+// them or removes the pin on POST /history/rollback/<n> and /history/unpin
+func historyHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		entries, err := History()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+
+	case "POST":
+		var err error
+		path := strings.TrimPrefix(req.URL.Path, "/history/")
+		if path == "unpin" {
+			err = Unpin()
+		} else if strings.HasPrefix(path, "rollback/") {
+			var n int
+			n, err = strconv.Atoi(strings.TrimPrefix(path, "rollback/"))
+			if err == nil {
+				var entry HistoryEntry
+				entry, err = RollbackHistory(n)
+				if err == nil {
+					json.NewEncoder(w).Encode(entry)
+				}
+			}
+		} else {
+			http.NotFound(w, req)
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
 	}
+}
+
+func startHTTPd(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats/", statsHandler)
+	mux.HandleFunc("/keys/", keyHandler)
+	mux.HandleFunc("/service/", stopServiceHandler)
+	mux.HandleFunc("/controlplane/", controlPlaneHandler)
+	mux.HandleFunc("/status/", statusHandler)
+	mux.HandleFunc("/reconcile/", localOnly(reconcileHandler(ctx)))
+	mux.HandleFunc("/applied/", localOnly(appliedHandler))
+	mux.HandleFunc("/history/", localOnly(historyHandler))
+
+	log.Infof("Starting web server on %s", ":53280")
+
+	server := &http.Server{Addr: ":53280", Handler: mux}
 
+	// on shutdown stop accepting requests, and return once the ones in
+	// progress are done
+	stopped := make(chan struct{})
+	shutdown := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdown <- server.Shutdown(context.Background())
+		case <-stopped:
+		}
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return <-shutdown
+	}
+	close(stopped)
+	return err
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	httpClient   *http.Client
+	streamClient *http.Client
+	httpLock     sync.Mutex
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HTTPClient returns the client used for every call to meshify
+func HTTPClient() (*http.Client, error) {
+	httpLock.Lock()
+	defer httpLock.Unlock()
+
+	if httpClient == nil {
+		err := newHTTPClients()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return httpClient, nil
+}
+
+// StreamClient returns a client sharing the same transport but without a
+// timeout, for connections that are expected to stay open
+func StreamClient() (*http.Client, error) {
+	httpLock.Lock()
+	defer httpLock.Unlock()
+
+	if streamClient == nil {
+		err := newHTTPClients()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return streamClient, nil
+}
+
+// ResetHTTPClient drops the shared clients so the next call picks up config changes
+func ResetHTTPClient() {
+	httpLock.Lock()
+	defer httpLock.Unlock()
+
+	if httpClient != nil {
+		httpClient.CloseIdleConnections()
+	}
+	httpClient = nil
+	streamClient = nil
+}
+
+func newHTTPClients() error {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy %s: %v", config.Proxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	// Create a transport like http.DefaultTransport, but with the configured LocalAddr
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 60 * time.Second,
+			LocalAddr: config.sourceAddr,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        10,
+	}
+
+	httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.Timeout) * time.Second,
+	}
+	streamClient = &http.Client{
+		Transport: transport,
+	}
+	return nil
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.TLSMinVersion != "" {
+		version, found := tlsVersions[config.TLSMinVersion]
+		if !found {
+			return nil, fmt.Errorf("invalid TLSMinVersion %s", config.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	// Trust a private CA in addition to the system roots
+	if config.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(dataFile(config.CACert))
+		if err != nil {
+			return nil, fmt.Errorf("error reading CACert: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// Client certificate for mTLS
+	if config.ClientCert != "" || config.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(dataFile(config.ClientCert), dataFile(config.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// dataFile resolves paths in the config relative to the data directory
+func dataFile(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return GetDataPath() + path
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Identity is a HostID and ApiKey the agent polls meshify with.  The HostID
+// and ApiKey at the top of the config are the default identity.  Any others,
+// possibly belonging to other meshify accounts, are listed in config.Identities
+// and keep their own meshify-<name>.conf and keys-<name>.json.
+type Identity struct {
+	Name        string
+	MeshifyHost string
+	HostID      string
+	ApiKey      string
+
+	// NextApiKey has been announced by meshify but not confirmed yet, and
+	// PreviousApiKey is the key we rotated away from
+	NextApiKey     string
+	PreviousApiKey string
+
+	// ControllerKey pins the key another meshify account signs with.  It
+	// defaults to the ControllerKey at the top of the config.
+	ControllerKey string
+
+	etag        string
+	policy      *RetryPolicy
+	controllers *ControllerSet
+}
+
+var defaultIdentity = &Identity{policy: hostPolicy}
+
+var identityNameFormat = regexp.MustCompile("^[a-zA-Z0-9_-]{1,32}$")
+
+// Identities returns every identity that can be polled, the default first
+func Identities() []*Identity {
+	ids := make([]*Identity, 0, len(config.Identities)+1)
+	if config.HostID != "" {
+		defaultIdentity.HostID = config.HostID
+		defaultIdentity.ApiKey = config.ApiKey
+		defaultIdentity.NextApiKey = config.NextApiKey
+		defaultIdentity.PreviousApiKey = config.PreviousApiKey
+		ids = append(ids, defaultIdentity)
+	}
+	for _, id := range config.Identities {
+		if id.HostID != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// IdentityFor returns the identity with the given HostID, or nil
+func IdentityFor(hostID string) *Identity {
+	for _, id := range Identities() {
+		if id.HostID == hostID {
+			return id
+		}
+	}
+	return nil
+}
+
+// IsSelf returns true if the host is this agent under any of its identities
+func IsSelf(host model.Host) bool {
+	return IdentityFor(host.HostGroup) != nil
+}
+
+// ValidateIdentities checks the names in config.Identities, which are used in file names
+func ValidateIdentities() error {
+	names := make(map[string]bool)
+	for _, id := range config.Identities {
+		if !identityNameFormat.MatchString(id.Name) || id.Name == "default" {
+			return &configError{"Identity name " + id.Name + " is not valid"}
+		}
+		if names[id.Name] {
+			return &configError{"Identity name " + id.Name + " is used more than once"}
+		}
+		names[id.Name] = true
+	}
+	return nil
+}
+
+func (id *Identity) String() string {
+	if id.Name == "" {
+		return "default"
+	}
+	return id.Name
+}
+
+// SetApiKey changes the identity's API key, and the config it came from
+func (id *Identity) SetApiKey(key string) {
+	id.ApiKey = key
+	if id == defaultIdentity {
+		config.ApiKey = key
+	}
+}
+
+// SetApiKeys changes all three keys of the identity
+func (id *Identity) SetApiKeys(current string, next string, previous string) {
+	id.SetApiKey(current)
+	id.NextApiKey = next
+	id.PreviousApiKey = previous
+	if id == defaultIdentity {
+		config.NextApiKey = next
+		config.PreviousApiKey = previous
+	}
+}
+
+// PinnedControllerKey is the key messages for this identity must be signed
+// with, or "" if they are not verified.  A nil identity, as for the service
+// config, uses the ControllerKey at the top of the config.
+func (id *Identity) PinnedControllerKey() string {
+	if id != nil && id.ControllerKey != "" {
+		return id.ControllerKey
+	}
+	return config.ControllerKey
+}
+
+// ConfPath is where the last message from meshify for this identity is kept
+func (id *Identity) ConfPath() string {
+	if id.Name == "" {
+		return GetDataPath() + "meshify.conf"
+	}
+	return GetDataPath() + "meshify-" + id.Name + ".conf"
+}
+
+// KeyPath is the key store for this identity
+func (id *Identity) KeyPath() string {
+	if id.Name == "" {
+		return GetDataPath() + "keys.json"
+	}
+	return GetDataPath() + "keys-" + id.Name + ".json"
+}
+
+// Policy backs off this identity's polling after client errors such as a 401
+func (id *Identity) Policy() *RetryPolicy {
+	if id.policy == nil {
+		id.policy = NewRetryPolicy("host "+id.String(), false)
+	}
+	return id.policy
+}
+
+// Controllers returns the controllers this identity talks to
+func (id *Identity) Controllers() *ControllerSet {
+	if id.controllers != nil {
+		return id.controllers
+	}
+	return Controllers
+}
+
+// LoadMessage reads the last message from meshify for this identity
+func (id *Identity) LoadMessage() (model.Message, error) {
+	var msg model.Message
+	data, err := ioutil.ReadFile(id.ConfPath())
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// LoadMessages merges the messages of every identity into one.  If two
+// identities have a mesh with the same name, the first identity keeps it.
+func LoadMessages() (model.Message, error) {
+	return MergeMessages(func(id *Identity) (model.Message, error) {
+		return id.LoadMessage()
+	})
+}
+
+// MergeMessages merges the messages returned by load for every identity, as
+// LoadMessages does for the messages on disk
+func MergeMessages(load func(id *Identity) (model.Message, error)) (model.Message, error) {
+	var all model.Message
+	var lastErr error
+	found := false
+	owners := make(map[string]string)
+
+	for _, id := range Identities() {
+		msg, err := load(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = true
+		for _, mesh := range msg.Config {
+			if owner, ok := owners[mesh.MeshName]; ok {
+				log.Errorf("Mesh %s from identity %s is already used by identity %s, ignoring it", mesh.MeshName, id, owner)
+				continue
+			}
+			owners[mesh.MeshName] = id.String()
+			all.Config = append(all.Config, mesh)
+		}
+	}
+
+	if !found {
+		return all, lastErr
+	}
+	return all, nil
+}
+
+// MeshOwner returns the identity whose message should configure the named mesh
+func MeshOwner(meshName string) *Identity {
+	for _, id := range Identities() {
+		msg, err := id.LoadMessage()
+		if err != nil {
+			continue
+		}
+		for _, mesh := range msg.Config {
+			if mesh.MeshName == meshName {
+				return id
+			}
+		}
+	}
+	return nil
+}
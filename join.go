@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var meshifyEnrollAPIFmt = "%s/api/v1.0/host/enroll"
+
+// EnrollRequest exchanges a one-time join token for a HostID and ApiKey.
+// Only the public key leaves this machine.
+type EnrollRequest struct {
+	Token     string `json:"token"`
+	PublicKey string `json:"publicKey"`
+	Name      string `json:"name"`
+	Platform  string `json:"platform"`
+	Version   string `json:"version"`
+}
+
+// EnrollResponse is the identity meshify created for the host
+type EnrollResponse struct {
+	HostID string `json:"hostId"`
+	ApiKey string `json:"apiKey"`
+}
+
+// Join enrolls this host with meshify using a join token and saves the
+// resulting HostID and ApiKey to the config.  With a name, the host is added
+// as another identity rather than the default one.
+//
+//	meshify-client [-server url] join <token> [name]
+func Join(args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("usage: meshify-client join <token> [name]")
+	}
+	token := args[0]
+	name := ""
+	if len(args) > 1 {
+		name = args[1]
+	}
+
+	// loadConfig stops early when there is no config file yet
+	normalizeHosts()
+	InitControllers()
+
+	var id *Identity
+	if name == "" {
+		if config.HostID != "" {
+			return fmt.Errorf("already enrolled as host %s", config.HostID)
+		}
+		id = defaultIdentity
+	} else {
+		for _, i := range config.Identities {
+			if i.Name == name {
+				return fmt.Errorf("identity %s already exists", name)
+			}
+		}
+		id = &Identity{Name: name}
+		config.Identities = append(config.Identities, id)
+		if err := ValidateIdentities(); err != nil {
+			config.Identities = config.Identities[:len(config.Identities)-1]
+			return err
+		}
+	}
+
+	// the private key is generated here and never sent to the server
+	wg, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	request := EnrollRequest{
+		Token:     token,
+		PublicKey: wg.PublicKey().String(),
+		Name:      hostname,
+		Platform:  Platform(),
+		Version:   Version,
+	}
+
+	response, err := Enroll(ActiveController(), id, request)
+	if err != nil {
+		return err
+	}
+	if response.HostID == "" || response.ApiKey == "" {
+		return fmt.Errorf("enrollment response is missing the HostID or ApiKey")
+	}
+
+	err = os.MkdirAll(GetDataPath(), 0700)
+	if err != nil {
+		return err
+	}
+
+	id.HostID = response.HostID
+	id.SetApiKey(response.ApiKey)
+	if id == defaultIdentity {
+		config.HostID = response.HostID
+	}
+
+	KeyAdd(id, request.PublicKey, wg.String())
+	err = KeySave(id)
+	if err != nil {
+		return err
+	}
+
+	err = saveConfig()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Joined meshify as host %s (identity %s)", id.HostID, id)
+	return nil
+}
+
+// Enroll posts the join token and public key to meshify, and checks the
+// answer against the controller key pinned for the identity
+func Enroll(ctl *Controller, id *Identity, request EnrollRequest) (*EnrollResponse, error) {
+	client, err := HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var reqURL string = fmt.Sprintf(meshifyEnrollAPIFmt, ctl.URL)
+	log.Infof("  POST %s", reqURL)
+	content, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		if resp.StatusCode == 401 || resp.StatusCode == 403 || resp.StatusCode == 404 {
+			return nil, fmt.Errorf("join token was not accepted, it may have expired or already been used")
+		}
+		return nil, NewAPIError(resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// with a pinned controller key, only trust credentials the controller signed
+	err = VerifyMessage(id, body, resp.Header.Get(signatureHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	var response EnrollResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
@@ -10,7 +10,8 @@ import (
 )
 
 var (
-	KeyStore map[string]string
+	// KeyStore holds the private keys of each identity, by public key
+	KeyStore map[string]map[string]string
 	KeyLock  sync.Mutex
 )
 
@@ -18,45 +19,56 @@ func KeyInitialize() {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	KeyStore = make(map[string]string)
+	KeyStore = make(map[string]map[string]string)
 }
 
-func KeyLookup(key string) (string, bool) {
+// KeyLookup finds a private key in the store of an identity
+func KeyLookup(id *Identity, key string) (string, bool) {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
-	value, found := KeyStore[key]
+
+	value, found := KeyStore[id.Name][key]
 	return value, found
 }
 
-func KeyAdd(public string, private string) {
+func KeyAdd(id *Identity, public string, private string) {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	KeyStore[public] = private
+	keys, found := KeyStore[id.Name]
+	if !found {
+		keys = make(map[string]string)
+		KeyStore[id.Name] = keys
+	}
+	keys[public] = private
 
 }
 
-func KeyDelete(key string) {
+func KeyDelete(id *Identity, key string) {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	delete(KeyStore, key)
+	delete(KeyStore[id.Name], key)
 }
 
-func KeySave() error {
+func KeySave(id *Identity) error {
 
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	file, err := os.OpenFile(GetDataPath()+"keys.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	file, err := os.OpenFile(id.KeyPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if file != nil {
 		defer file.Close()
 	}
 	if err != nil {
-		log.Errorf("Error opening keys.json for write: %v", err)
+		log.Errorf("Error opening %s for write: %v", id.KeyPath(), err)
 		return err
 	}
-	bytes, err := json.Marshal(KeyStore)
+	keys := KeyStore[id.Name]
+	if keys == nil {
+		keys = make(map[string]string)
+	}
+	bytes, err := json.Marshal(keys)
 	if err != nil {
 		log.Errorf("Error marshalling json: %v", err)
 	}
@@ -65,13 +77,13 @@ func KeySave() error {
 	return err
 }
 
-func KeyLoad() error {
+func KeyLoad(id *Identity) error {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	file, err := os.Open(GetDataPath() + "keys.json")
+	file, err := os.Open(id.KeyPath())
 	if err != nil {
-		log.Errorf("Error opening keys.json for read: %v", err)
+		log.Errorf("Error opening %s for read: %v", id.KeyPath(), err)
 		return err
 	}
 
@@ -79,14 +91,24 @@ func KeyLoad() error {
 	file.Close()
 
 	if err != nil {
-		log.Errorf("Error reading keys.json: %v", err)
+		log.Errorf("Error reading %s: %v", id.KeyPath(), err)
 		return err
 	}
 
-	err = json.Unmarshal(bytes, &KeyStore)
+	keys := make(map[string]string)
+	err = json.Unmarshal(bytes, &keys)
 	if err != nil {
 		log.Errorf("Error unmarshalling json: %v", err)
 	}
+	KeyStore[id.Name] = keys
 
 	return err
 }
+
+// KeyLoadAll loads the key store of the default identity and every configured identity
+func KeyLoadAll() {
+	KeyLoad(defaultIdentity)
+	for _, id := range config.Identities {
+		KeyLoad(id)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"strings"
@@ -27,10 +29,51 @@ func main() {
 	}
 
 	KeyInitialize()
-	KeyLoad()
+	KeyLoadAll()
 
 	const svcName = "meshify"
 
+	// these commands may follow flags such as -server, which loadConfig has already parsed
+	if flag.NArg() > 0 {
+		switch strings.ToLower(flag.Arg(0)) {
+		case "join":
+			err = Join(flag.Args()[1:])
+			if err != nil {
+				log.Errorf("Join failed: %v", err)
+				os.Exit(1)
+			}
+			return
+		case "plan":
+			err = DryRun(flag.Args()[1:])
+			if err != nil {
+				log.Errorf("Plan failed: %v", err)
+				os.Exit(1)
+			}
+			return
+		case "upnp":
+			err = UPnPCommand(flag.Args()[1:])
+			if err != nil {
+				log.Errorf("UPnP failed: %v", err)
+				os.Exit(1)
+			}
+			return
+		case "stun":
+			err = StunCommand(flag.Args()[1:])
+			if err != nil {
+				log.Errorf("STUN failed: %v", err)
+				os.Exit(1)
+			}
+			return
+		case "history", "rollback", "unpin":
+			err = HistoryCommand(strings.ToLower(flag.Arg(0)), flag.Args()[1:])
+			if err != nil {
+				log.Errorf("%s failed: %v", flag.Arg(0), err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	inService, _ := InService()
 	if inService {
 		RunService(svcName)
@@ -46,8 +89,8 @@ func main() {
 	} else {
 		log.Infof("Meshify Control Plane Started")
 
-		DoWork()
-		DoServiceWork()
+		agent := StartAgent(context.Background())
+		DoServiceWork(agent)
 
 		sigs := make(chan os.Signal, 1)
 		done := make(chan bool, 1)
@@ -61,6 +104,7 @@ func main() {
 
 		<-done
 
+		StopAgent(agent)
 		log.Info("Exiting")
 	}
 
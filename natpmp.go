@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// PCP (RFC 6887) and NAT-PMP (RFC 6886) share a port on the gateway, and a
+// NAT-PMP gateway answers a PCP request with an unsupported version error
+const (
+	natpmpPort        = 5351
+	natpmpVersion     = 0
+	pcpVersion        = 2
+	pcpOpAnnounce     = 0
+	pcpOpMap          = 1
+	natpmpOpAddress   = 0
+	natpmpOpMapUDP    = 1
+	natpmpTimeout     = 250 * time.Millisecond
+	natpmpAttempts    = 3
+	protocolUDPNumber = 17
+)
+
+// gatewayRequest sends a request to the PCP/NAT-PMP port of the gateway,
+// retrying with a doubling timeout, and returns the first answer that ok
+// accepts
+func gatewayRequest(gateway net.IP, request []byte, ok func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1100)
+	for attempt := 0; attempt < natpmpAttempts; attempt++ {
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(natpmpTimeout << attempt))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if ok(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no answer from %s", gateway)
+}
+
+// natpmpMapper maps ports with NAT-PMP
+type natpmpMapper struct {
+	gateway net.IP
+}
+
+func newNATPMPMapper(gateway net.IP) (*natpmpMapper, error) {
+	m := &natpmpMapper{gateway: gateway}
+	_, err := m.ExternalAddress()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *natpmpMapper) Protocol() string {
+	return "NAT-PMP"
+}
+
+func natpmpResult(response []byte) error {
+	if code := binary.BigEndian.Uint16(response[2:]); code != 0 {
+		return fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return nil
+}
+
+func (m *natpmpMapper) ExternalAddress() (net.IP, error) {
+	response, err := gatewayRequest(m.gateway, []byte{natpmpVersion, natpmpOpAddress}, func(r []byte) bool {
+		return len(r) >= 12 && r[0] == natpmpVersion && r[1] == 128+natpmpOpAddress
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = natpmpResult(response)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte{}, response[8:12]...)), nil
+}
+
+func (m *natpmpMapper) mapUDP(internalPort uint16, externalPort uint16, lifetime time.Duration) ([]byte, error) {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(request[4:], internalPort)
+	binary.BigEndian.PutUint16(request[6:], externalPort)
+	binary.BigEndian.PutUint32(request[8:], uint32(lifetime/time.Second))
+
+	response, err := gatewayRequest(m.gateway, request, func(r []byte) bool {
+		return len(r) >= 16 && r[0] == natpmpVersion && r[1] == 128+natpmpOpMapUDP &&
+			binary.BigEndian.Uint16(r[8:]) == internalPort
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, natpmpResult(response)
+}
+
+func (m *natpmpMapper) MapPort(port uint16, lifetime time.Duration, description string) (*PortMapping, error) {
+	response, err := m.mapUDP(port, port, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &PortMapping{
+		Protocol:     m.Protocol(),
+		Description:  description,
+		InternalPort: port,
+		ExternalPort: binary.BigEndian.Uint16(response[10:]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[12:])) * time.Second,
+	}, nil
+}
+
+func (m *natpmpMapper) Renew(mapping *PortMapping, lifetime time.Duration) (*PortMapping, error) {
+	response, err := m.mapUDP(mapping.InternalPort, mapping.ExternalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	renewed := *mapping
+	renewed.ExternalPort = binary.BigEndian.Uint16(response[10:])
+	renewed.Lifetime = time.Duration(binary.BigEndian.Uint32(response[12:])) * time.Second
+	return &renewed, nil
+}
+
+// UnmapPort asks for a lifetime of zero, which deletes the mapping
+func (m *natpmpMapper) UnmapPort(mapping *PortMapping) error {
+	_, err := m.mapUDP(mapping.InternalPort, 0, 0)
+	return err
+}
+
+// pcpMapper maps ports with PCP.  The same nonce must be sent to renew or
+// delete a mapping, so it is kept in the mapping.
+type pcpMapper struct {
+	gateway net.IP
+	local   net.IP
+
+	lock     sync.Mutex
+	external net.IP
+}
+
+func newPCPMapper(gateway net.IP, local net.IP) (*pcpMapper, error) {
+	m := &pcpMapper{gateway: gateway, local: local}
+	_, err := m.request(pcpOpAnnounce, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *pcpMapper) Protocol() string {
+	return "PCP"
+}
+
+// request sends a PCP request, with the opcode specific data in payload
+func (m *pcpMapper) request(opcode byte, lifetime time.Duration, payload []byte) ([]byte, error) {
+	request := make([]byte, 24+len(payload))
+	request[0] = pcpVersion
+	request[1] = opcode
+	binary.BigEndian.PutUint32(request[4:], uint32(lifetime/time.Second))
+	copy(request[8:24], m.local.To16())
+	copy(request[24:], payload)
+
+	response, err := gatewayRequest(m.gateway, request, func(r []byte) bool {
+		if len(r) >= 4 && r[0] == natpmpVersion {
+			// a NAT-PMP gateway, which will say so
+			return true
+		}
+		return len(r) >= 24 && r[0] == pcpVersion && r[1] == 0x80|opcode &&
+			(len(payload) < 12 || len(r) >= 24+len(payload) && string(r[24:36]) == string(payload[:12]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response[0] != pcpVersion {
+		return nil, errors.New("gateway does not support PCP")
+	}
+	if code := response[3]; code != 0 {
+		return nil, fmt.Errorf("PCP result code %d", code)
+	}
+	return response, nil
+}
+
+func (m *pcpMapper) mapUDP(nonce []byte, port uint16, externalPort uint16, lifetime time.Duration) ([]byte, error) {
+	payload := make([]byte, 36)
+	copy(payload[0:12], nonce)
+	payload[12] = protocolUDPNumber
+	binary.BigEndian.PutUint16(payload[16:], port)
+	binary.BigEndian.PutUint16(payload[18:], externalPort)
+	copy(payload[20:36], net.IPv4zero.To16())
+	return m.request(pcpOpMap, lifetime, payload)
+}
+
+// ExternalAddress is the one the gateway gave the last mapping, as PCP has no
+// request for it on its own
+func (m *pcpMapper) ExternalAddress() (net.IP, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.external == nil {
+		return nil, errors.New("no PCP mapping yet")
+	}
+	return m.external, nil
+}
+
+func (m *pcpMapper) MapPort(port uint16, lifetime time.Duration, description string) (*PortMapping, error) {
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return m.mapping(&PortMapping{Protocol: m.Protocol(), Description: description, InternalPort: port, ExternalPort: port, Nonce: nonce}, lifetime)
+}
+
+func (m *pcpMapper) Renew(mapping *PortMapping, lifetime time.Duration) (*PortMapping, error) {
+	return m.mapping(mapping, lifetime)
+}
+
+// mapping asks for a mapping like the one given, and returns what the
+// gateway granted
+func (m *pcpMapper) mapping(mapping *PortMapping, lifetime time.Duration) (*PortMapping, error) {
+	response, err := m.mapUDP(mapping.Nonce, mapping.InternalPort, mapping.ExternalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	external := net.IP(append([]byte{}, response[44:60]...))
+	if ip := external.To4(); ip != nil {
+		external = ip
+	}
+	m.lock.Lock()
+	m.external = external
+	m.lock.Unlock()
+
+	granted := *mapping
+	granted.ExternalPort = binary.BigEndian.Uint16(response[42:])
+	granted.ExternalIP = external.String()
+	granted.Lifetime = time.Duration(binary.BigEndian.Uint32(response[4:])) * time.Second
+	return &granted, nil
+}
+
+func (m *pcpMapper) UnmapPort(mapping *PortMapping) error {
+	_, err := m.mapUDP(mapping.Nonce, mapping.InternalPort, 0, 0)
+	return err
+}
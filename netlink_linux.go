@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The first routing table tried for a default route through the mesh, as wg-quick does
+const defaultRouteTable = 51820
+
+// errNoKernelWireguard means the kernel can't create wireguard interfaces,
+// so the userspace driver has to be used instead
+var errNoKernelWireguard = errors.New("kernel has no wireguard support")
+
+// netlinkDriver creates kernel wireguard interfaces and sets up their
+// addresses, routes and DNS the way wg-quick up does, without running it
+type netlinkDriver struct{}
+
+func init() {
+	RegisterDriver("netlink", netlinkDriver{})
+}
+
+func (netlinkDriver) Up(meshName string, conf []byte) error {
+	c, err := parseWireguardConfig(conf)
+	if err != nil {
+		return err
+	}
+	return bringUp(meshName, c, createLink, removeLink)
+}
+
+func (netlinkDriver) Down(meshName string) error {
+	return bringDown(meshName, removeLink)
+}
+
+func (netlinkDriver) ApplyPeers(meshName string, changes *PeerChanges) error {
+	return changes.Apply(meshName)
+}
+
+func (netlinkDriver) Stats(meshName string) (string, error) {
+	return wgctrlStats(meshName)
+}
+
+func (netlinkDriver) Interfaces() ([]string, error) {
+	return wgctrlInterfaces()
+}
+
+func createWireguardLink(meshName string) error {
+	link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: meshName}}
+	err := netlink.LinkAdd(link)
+	if err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return errNoKernelWireguard
+		}
+		return fmt.Errorf("error creating %s: %v", meshName, err)
+	}
+	return nil
+}
+
+// createLink creates a kernel wireguard interface, or one in userspace if the
+// kernel has no wireguard.  Falling back here rather than starting over keeps
+// the PreUp hooks from running twice.
+func createLink(meshName string) error {
+	err := createWireguardLink(meshName)
+	if err == errNoKernelWireguard {
+		log.Infof("No wireguard in the kernel, starting %s in userspace", meshName)
+		return userspace.create(meshName)
+	}
+	return err
+}
+
+// removeLink undoes createLink
+func removeLink(meshName string) error {
+	if userspace.Running(meshName) {
+		return userspace.remove(meshName)
+	}
+	return deleteLink(meshName)
+}
+
+func deleteLink(meshName string) error {
+	link, err := netlink.LinkByName(meshName)
+	if err != nil {
+		return nil
+	}
+	err = netlink.LinkDel(link)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %v", meshName, err)
+	}
+	return nil
+}
+
+// bringUp creates the interface of a mesh with create and sets it up from
+// its config, running the hooks around it.  remove undoes create on failure.
+func bringUp(meshName string, conf *wgQuickConfig, create func(string) error, remove func(string) error) error {
+	if _, err := netlink.LinkByName(meshName); err == nil {
+		return fmt.Errorf("%s already exists", meshName)
+	}
+
+	err := runHooks(meshName, conf.Interface["preup"])
+	if err != nil {
+		return err
+	}
+
+	err = create(meshName)
+	if err != nil {
+		return err
+	}
+
+	err = setupInterface(meshName, conf)
+	if err != nil {
+		cleanupInterface(meshName, conf, remove)
+		return err
+	}
+
+	err = runHooks(meshName, conf.Interface["postup"])
+	if err != nil {
+		cleanupInterface(meshName, conf, remove)
+		return err
+	}
+	return nil
+}
+
+// bringDown removes a mesh started by bringUp.  The config it was started
+// with is still on disk for the hooks.
+func bringDown(meshName string, remove func(string) error) error {
+	conf := &wgQuickConfig{Interface: make(wgSection), Peers: make(map[string]wgSection)}
+	data, err := ioutil.ReadFile(GetWireguardPath() + meshName + ".conf")
+	if err == nil {
+		if c, err := parseWireguardConfig(data); err == nil {
+			conf = c
+		}
+	}
+
+	if _, err := netlink.LinkByName(meshName); err != nil {
+		return fmt.Errorf("%s is not running", meshName)
+	}
+
+	err = runHooks(meshName, conf.Interface["predown"])
+	if err != nil {
+		log.Errorf("Error running PreDown of %s: %v", meshName, err)
+	}
+	err = cleanupInterface(meshName, conf, remove)
+	if err != nil {
+		return err
+	}
+	err = runHooks(meshName, conf.Interface["postdown"])
+	if err != nil {
+		log.Errorf("Error running PostDown of %s: %v", meshName, err)
+	}
+	return nil
+}
+
+// cleanupInterface removes the rules and DNS settings of a mesh, then the
+// interface itself with remove
+func cleanupInterface(meshName string, conf *wgQuickConfig, remove func(string) error) error {
+	table := 0
+	if wg, err := wgctrl.New(); err == nil {
+		if device, err := wg.Device(meshName); err == nil {
+			table = device.FirewallMark
+		}
+		wg.Close()
+	}
+	if table != 0 {
+		deleteDefaultRouteRules(table)
+	}
+
+	if len(conf.Interface["dns"]) > 0 {
+		err := unsetDNS(meshName)
+		if err != nil {
+			log.Errorf("Error removing the DNS settings of %s: %v", meshName, err)
+		}
+	}
+
+	return remove(meshName)
+}
+
+// setupInterface configures a new wireguard interface: keys and peers first,
+// then addresses, MTU, routes and DNS
+func setupInterface(meshName string, conf *wgQuickConfig) error {
+	link, err := netlink.LinkByName(meshName)
+	if err != nil {
+		return err
+	}
+
+	wgconf := wgtypes.Config{ReplacePeers: true}
+	key, err := wgtypes.ParseKey(conf.Interface.get("privatekey"))
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	wgconf.PrivateKey = &key
+	if value := conf.Interface.get("listenport"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid listen port %s", value)
+		}
+		wgconf.ListenPort = &port
+	}
+	if value := conf.Interface.get("fwmark"); value != "" && value != "off" {
+		mark, err := strconv.ParseInt(value, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid fwmark %s", value)
+		}
+		m := int(mark)
+		wgconf.FirewallMark = &m
+	}
+	for key, peer := range conf.Peers {
+		pc, err := peerConfig(key, peer)
+		if err != nil {
+			return fmt.Errorf("peer %s: %v", key, err)
+		}
+		wgconf.Peers = append(wgconf.Peers, pc)
+	}
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer wg.Close()
+	err = wg.ConfigureDevice(meshName, wgconf)
+	if err != nil {
+		return fmt.Errorf("error configuring %s: %v", meshName, err)
+	}
+
+	for _, value := range conf.Interface["address"] {
+		for _, address := range strings.Split(value, ",") {
+			address = strings.TrimSpace(address)
+			if address == "" {
+				continue
+			}
+			if !strings.Contains(address, "/") {
+				if strings.Contains(address, ":") {
+					address += "/128"
+				} else {
+					address += "/32"
+				}
+			}
+			addr, err := netlink.ParseAddr(address)
+			if err != nil {
+				return fmt.Errorf("invalid address %s: %v", address, err)
+			}
+			err = netlink.AddrAdd(link, addr)
+			if err != nil {
+				return fmt.Errorf("error adding address %s: %v", address, err)
+			}
+		}
+	}
+
+	mtu := 0
+	if value := conf.Interface.get("mtu"); value != "" {
+		mtu, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid MTU %s", value)
+		}
+	} else {
+		mtu = defaultMTU()
+	}
+	err = netlink.LinkSetMTU(link, mtu)
+	if err != nil {
+		return fmt.Errorf("error setting the MTU of %s to %d: %v", meshName, mtu, err)
+	}
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return fmt.Errorf("error bringing up %s: %v", meshName, err)
+	}
+
+	if dns := conf.Interface["dns"]; len(dns) > 0 {
+		err = setDNS(meshName, dns)
+		if err != nil {
+			return fmt.Errorf("error setting DNS for %s: %v", meshName, err)
+		}
+	}
+
+	return addRoutes(meshName, link, conf)
+}
+
+// defaultMTU is the MTU wg-quick picks when none is set: that of the default
+// route's interface less the wireguard overhead
+func defaultMTU() int {
+	mtu := 1500
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err == nil {
+		for _, route := range routes {
+			if route.Dst != nil || route.LinkIndex == 0 {
+				continue
+			}
+			if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil && link.Attrs().MTU > 0 {
+				mtu = link.Attrs().MTU
+				break
+			}
+		}
+	}
+	return mtu - 80
+}
+
+// addRoutes routes the allowed IPs of every peer to the interface.  Table
+// off adds no routes, a number puts them in that table, and otherwise they go
+// in the main table except a default route, which gets its own table and
+// rules so wireguard's own packets don't loop through the mesh.
+func addRoutes(meshName string, link netlink.Link, conf *wgQuickConfig) error {
+	setting := strings.ToLower(conf.Interface.get("table"))
+	if setting == "off" {
+		return nil
+	}
+	table := 0
+	if setting != "" && setting != "auto" {
+		t, err := strconv.Atoi(setting)
+		if err != nil {
+			if t, err = routeTableByName(setting); err != nil {
+				return fmt.Errorf("invalid table %s", setting)
+			}
+		}
+		table = t
+	}
+
+	// most specific first, as wg-quick does
+	nets := make([]*net.IPNet, 0)
+	for cidr := range routeSet(conf) {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	sort.Slice(nets, func(i, j int) bool {
+		a, _ := nets[i].Mask.Size()
+		b, _ := nets[j].Mask.Size()
+		if a != b {
+			return a > b
+		}
+		return nets[i].String() < nets[j].String()
+	})
+
+	defaultTable := 0
+	for _, n := range nets {
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: n, Scope: netlink.SCOPE_LINK, Table: table}
+		if ones, _ := n.Mask.Size(); ones == 0 && table == 0 {
+			if defaultTable == 0 {
+				defaultTable = freeRouteTable()
+				err := addDefaultRouteRules(meshName, defaultTable)
+				if err != nil {
+					return err
+				}
+			}
+			route.Table = defaultTable
+			err := addDefaultRouteRule(n, defaultTable)
+			if err != nil {
+				return err
+			}
+		}
+		err := netlink.RouteReplace(route)
+		if err != nil {
+			return fmt.Errorf("error adding route %s: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// routeTableByName looks up a table in /etc/iproute2/rt_tables
+func routeTableByName(name string) (int, error) {
+	data, err := ioutil.ReadFile("/etc/iproute2/rt_tables")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == name {
+			return strconv.Atoi(fields[0])
+		}
+	}
+	return 0, fmt.Errorf("no table %s", name)
+}
+
+// freeRouteTable finds a routing table with no routes in it, starting at 51820
+func freeRouteTable() int {
+	table := defaultRouteTable
+	for {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil || len(routes) == 0 {
+			return table
+		}
+		table++
+	}
+}
+
+// addDefaultRouteRules marks the packets of the mesh with the table number,
+// so they bypass the default route through it
+func addDefaultRouteRules(meshName string, table int) error {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer wg.Close()
+	err = wg.ConfigureDevice(meshName, wgtypes.Config{FirewallMark: &table})
+	if err != nil {
+		return fmt.Errorf("error setting the fwmark of %s: %v", meshName, err)
+	}
+
+	// replies to marked packets have to be accepted on their way back in
+	err = ioutil.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0644)
+	if err != nil {
+		log.Errorf("Error setting src_valid_mark: %v", err)
+	}
+	return nil
+}
+
+// addDefaultRouteRule sends unmarked traffic of one family to the table,
+// while routes more specific than a default in the main table still apply
+func addDefaultRouteRule(n *net.IPNet, table int) error {
+	family := netlink.FAMILY_V4
+	if n.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = table
+	rule.Mark = table
+	rule.Invert = true
+	err := netlink.RuleAdd(rule)
+	if err != nil {
+		return fmt.Errorf("error adding rule for table %d: %v", table, err)
+	}
+
+	rule = netlink.NewRule()
+	rule.Family = family
+	rule.Table = unix.RT_TABLE_MAIN
+	rule.SuppressPrefixlen = 0
+	err = netlink.RuleAdd(rule)
+	if err != nil {
+		return fmt.Errorf("error adding rule for the main table: %v", err)
+	}
+	return nil
+}
+
+// deleteDefaultRouteRules removes the rules added by addDefaultRouteRule
+func deleteDefaultRouteRules(table int) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			ours := rule.Dst == nil && rule.Table == table && rule.Mark == table && rule.Invert
+			if !ours {
+				continue
+			}
+			r := rule
+			r.Family = family
+			if err := netlink.RuleDel(&r); err != nil {
+				log.Errorf("Error deleting rule for table %d: %v", table, err)
+			}
+
+			main := netlink.NewRule()
+			main.Family = family
+			main.Table = unix.RT_TABLE_MAIN
+			main.SuppressPrefixlen = 0
+			netlink.RuleDel(main)
+		}
+	}
+}
+
+// runHooks runs the PreUp, PostUp, PreDown or PostDown commands of a mesh,
+// with %i replaced by the interface name
+func runHooks(meshName string, hooks []string) error {
+	for _, hook := range hooks {
+		hook = strings.ReplaceAll(hook, "%i", meshName)
+		cmd := exec.Command("/bin/sh", "-c", hook)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%s: %v (%s)", hook, err, strings.TrimSpace(out.String()))
+		}
+	}
+	return nil
+}
+
+// splitDNS separates the DNS setting into servers and search domains
+func splitDNS(values []string) ([]string, []string) {
+	servers := make([]string, 0)
+	domains := make([]string, 0)
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if net.ParseIP(entry) != nil {
+				servers = append(servers, entry)
+			} else {
+				domains = append(domains, entry)
+			}
+		}
+	}
+	return servers, domains
+}
+
+// resolvConfBackup is where the original /etc/resolv.conf is kept while any
+// mesh has replaced it, and resolvConfMesh the one generated for each mesh
+func resolvConfBackup() string {
+	return GetDataPath() + "resolv.conf"
+}
+
+func resolvConfMesh(meshName string) string {
+	return GetDataPath() + "resolv.conf." + meshName
+}
+
+var resolvConfLock sync.Mutex
+
+// setDNS points the resolver at the DNS servers of a mesh.  systemd-resolved
+// is given the servers for the interface, and resolvconf a resolv.conf for
+// it, as wg-quick does.  Otherwise /etc/resolv.conf is rewritten in place,
+// since it may be a bind mount or a symlink something else manages.  The
+// original is kept by the first mesh to rewrite it, so meshes can go down in
+// any order and it is still the one put back.
+func setDNS(meshName string, values []string) error {
+	servers, domains := splitDNS(values)
+
+	if resolved() {
+		args := append([]string{"dns", meshName}, servers...)
+		err := runCommand("resolvectl", args...)
+		if err != nil {
+			return err
+		}
+		// route every query through the mesh, as with resolv.conf
+		args = append([]string{"domain", meshName, "~."}, domains...)
+		return runCommand("resolvectl", args...)
+	}
+
+	var conf bytes.Buffer
+	fmt.Fprintf(&conf, "# Generated by meshify-client for %s\n", meshName)
+	for _, server := range servers {
+		fmt.Fprintf(&conf, "nameserver %s\n", server)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&conf, "search %s\n", strings.Join(domains, " "))
+	}
+
+	if _, err := exec.LookPath("resolvconf"); err == nil {
+		cmd := exec.Command("resolvconf", "-a", resolvconfInterface(meshName), "-m", "0", "-x")
+		cmd.Stdin = &conf
+		var out bytes.Buffer
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("resolvconf: %v (%s)", err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	}
+
+	resolvConfLock.Lock()
+	defer resolvConfLock.Unlock()
+
+	if _, err := os.Stat(resolvConfBackup()); os.IsNotExist(err) {
+		original, err := ioutil.ReadFile("/etc/resolv.conf")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = ioutil.WriteFile(resolvConfBackup(), original, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ioutil.WriteFile(resolvConfMesh(meshName), conf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return writeResolvConf(conf.Bytes())
+}
+
+// unsetDNS undoes setDNS.  If other meshes still have DNS, resolv.conf goes
+// to the one that set it last, and the original only comes back with the last.
+func unsetDNS(meshName string) error {
+	resolvConfLock.Lock()
+	defer resolvConfLock.Unlock()
+
+	path := resolvConfMesh(meshName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := exec.LookPath("resolvconf"); err == nil {
+			return runCommand("resolvconf", "-d", resolvconfInterface(meshName), "-f")
+		}
+		// systemd-resolved forgets the interface when it is deleted
+		return nil
+	}
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	others, _ := filepath.Glob(resolvConfMesh("*"))
+	latest := ""
+	var latestTime time.Time
+	for _, other := range others {
+		if info, err := os.Stat(other); err == nil && info.ModTime().After(latestTime) {
+			latest, latestTime = other, info.ModTime()
+		}
+	}
+	if latest != "" {
+		conf, err := ioutil.ReadFile(latest)
+		if err != nil {
+			return err
+		}
+		return writeResolvConf(conf)
+	}
+
+	original, err := ioutil.ReadFile(resolvConfBackup())
+	if err != nil {
+		return err
+	}
+	err = writeResolvConf(original)
+	if err != nil {
+		return err
+	}
+	return os.Remove(resolvConfBackup())
+}
+
+// writeResolvConf truncates and rewrites /etc/resolv.conf.  Renaming a new
+// file over it fails on a bind mount, as in a container, and would replace
+// a symlink.
+func writeResolvConf(data []byte) error {
+	file, err := os.OpenFile("/etc/resolv.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// resolvconfInterface is the name the DNS of a mesh is given to resolvconf
+// under, with the prefix its interface-order puts ahead of the others, as
+// wg-quick does
+func resolvconfInterface(meshName string) string {
+	order, err := ioutil.ReadFile("/etc/resolvconf/interface-order")
+	if err == nil {
+		for _, line := range strings.Split(string(order), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "tun.") {
+				return "tun." + meshName
+			}
+		}
+	}
+	return meshName
+}
+
+// resolved is true if systemd-resolved manages DNS on this host
+func resolved() bool {
+	if _, err := os.Stat("/run/systemd/resolve/io.systemd.Resolve"); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("resolvectl")
+	return err == nil
+}
+
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %v (%s)", name, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
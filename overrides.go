@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Override holds local changes to the settings from meshify.  Fields that are
+// not set keep the value from meshify.
+type Override struct {
+	Mtu                 *int     `json:"mtu,omitempty"`
+	ListenPort          *int     `json:"listenPort,omitempty"`
+	Dns                 []string `json:"dns,omitempty"`
+	PreUp               *string  `json:"preUp,omitempty"`
+	PostUp              *string  `json:"postUp,omitempty"`
+	PreDown             *string  `json:"preDown,omitempty"`
+	PostDown            *string  `json:"postDown,omitempty"`
+	Endpoint            *string  `json:"endpoint,omitempty"`
+	PersistentKeepalive *int     `json:"persistentKeepalive,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs,omitempty"`
+
+	// ExcludeAllowedIPs are removed from the AllowedIPs of the peers
+	ExcludeAllowedIPs []string `json:"excludeAllowedIPs,omitempty"`
+}
+
+// MeshOverride is the overrides of one mesh.  The top level applies to this
+// host, and the exclusions to every peer.  Peers holds the overrides of
+// single peers by public key.
+type MeshOverride struct {
+	Override
+	Peers map[string]Override `json:"peers,omitempty"`
+}
+
+// OverridesPath is the file of local overrides, by mesh name
+func OverridesPath() string {
+	return GetDataPath() + "overrides.json"
+}
+
+// LoadOverrides reads the overrides file.  No file means no overrides.
+func LoadOverrides() (map[string]MeshOverride, error) {
+	overrides := make(map[string]MeshOverride)
+	data, err := ioutil.ReadFile(OverridesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return overrides, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", OverridesPath(), err)
+	}
+
+	for mesh, o := range overrides {
+		err = o.validate()
+		for key, p := range o.Peers {
+			if err == nil {
+				err = p.validate()
+			}
+			if err != nil {
+				err = fmt.Errorf("peer %s: %v", key, err)
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error in %s, mesh %s: %v", OverridesPath(), mesh, err)
+		}
+	}
+	return overrides, nil
+}
+
+func (o Override) validate() error {
+	for _, cidr := range append(append([]string{}, o.AllowedIPs...), o.ExcludeAllowedIPs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %s", cidr)
+		}
+	}
+	if o.Mtu != nil && (*o.Mtu < 576 || *o.Mtu > 65535) {
+		return fmt.Errorf("invalid MTU %d", *o.Mtu)
+	}
+	if o.ListenPort != nil && (*o.ListenPort < 0 || *o.ListenPort > 65535) {
+		return fmt.Errorf("invalid listen port %d", *o.ListenPort)
+	}
+	return nil
+}
+
+// ApplyOverrides changes the host and peers of a mesh before it is rendered
+func (o MeshOverride) ApplyOverrides(host *model.Host, peers []model.Host) {
+	o.Override.apply(&host.Current)
+
+	found := make(map[string]bool)
+	for i := range peers {
+		key := peers[i].Current.PublicKey
+		if p, ok := o.Peers[key]; ok {
+			p.apply(&peers[i].Current)
+			found[key] = true
+		}
+		if len(o.ExcludeAllowedIPs) > 0 {
+			peers[i].Current.AllowedIPs = excludeCIDRs(peers[i].Current.AllowedIPs, o.ExcludeAllowedIPs)
+		}
+	}
+	for key := range o.Peers {
+		if !found[key] {
+			log.Errorf("Override for peer %s of mesh %s, which is not in the mesh", key, host.MeshName)
+		}
+	}
+}
+
+func (o Override) apply(s *model.Settings) {
+	if o.Mtu != nil {
+		s.Mtu = *o.Mtu
+	}
+	if o.ListenPort != nil {
+		s.ListenPort = *o.ListenPort
+	}
+	if o.Dns != nil {
+		s.Dns = o.Dns
+	}
+	if o.PreUp != nil {
+		s.PreUp = *o.PreUp
+	}
+	if o.PostUp != nil {
+		s.PostUp = *o.PostUp
+	}
+	if o.PreDown != nil {
+		s.PreDown = *o.PreDown
+	}
+	if o.PostDown != nil {
+		s.PostDown = *o.PostDown
+	}
+	if o.Endpoint != nil {
+		s.Endpoint = *o.Endpoint
+	}
+	if o.PersistentKeepalive != nil {
+		s.PersistentKeepalive = *o.PersistentKeepalive
+	}
+	if o.AllowedIPs != nil {
+		s.AllowedIPs = o.AllowedIPs
+	}
+	if len(o.ExcludeAllowedIPs) > 0 {
+		s.AllowedIPs = excludeCIDRs(s.AllowedIPs, o.ExcludeAllowedIPs)
+	}
+}
+
+// excludeCIDRs takes the excluded networks out of a list of CIDRs
+func excludeCIDRs(cidrs []string, exclude []string) []string {
+	prefixes := make([]netip.Prefix, 0, len(exclude))
+	for _, e := range exclude {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	result, _ := subtractCIDRs(cidrs, prefixes)
+	return result
+}
+
+// Describe lists the overrides for display, such as mtu=1280
+func (o MeshOverride) Describe() []string {
+	list := o.Override.describe("")
+
+	keys := make([]string, 0, len(o.Peers))
+	for key := range o.Peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		list = append(list, o.Peers[key].describe("peer "+key+" ")...)
+	}
+	return list
+}
+
+func (o Override) describe(prefix string) []string {
+	list := make([]string, 0)
+	add := func(name string, value interface{}) {
+		list = append(list, fmt.Sprintf("%s%s=%v", prefix, name, value))
+	}
+	if o.Mtu != nil {
+		add("mtu", *o.Mtu)
+	}
+	if o.ListenPort != nil {
+		add("listenPort", *o.ListenPort)
+	}
+	if o.Dns != nil {
+		add("dns", strings.Join(o.Dns, ","))
+	}
+	if o.PreUp != nil {
+		add("preUp", *o.PreUp)
+	}
+	if o.PostUp != nil {
+		add("postUp", *o.PostUp)
+	}
+	if o.PreDown != nil {
+		add("preDown", *o.PreDown)
+	}
+	if o.PostDown != nil {
+		add("postDown", *o.PostDown)
+	}
+	if o.Endpoint != nil {
+		add("endpoint", *o.Endpoint)
+	}
+	if o.PersistentKeepalive != nil {
+		add("persistentKeepalive", *o.PersistentKeepalive)
+	}
+	if o.AllowedIPs != nil {
+		add("allowedIPs", strings.Join(o.AllowedIPs, ","))
+	}
+	if len(o.ExcludeAllowedIPs) > 0 {
+		add("excludeAllowedIPs", strings.Join(o.ExcludeAllowedIPs, ","))
+	}
+	return list
+}
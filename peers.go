@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// wgSection is one section of a wg-quick config, keys in lower case
+type wgSection map[string][]string
+
+func (s wgSection) get(key string) string {
+	values := s[key]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// wgQuickConfig is a parsed wg-quick config file, with the peers by public key
+type wgQuickConfig struct {
+	Interface wgSection
+	Peers     map[string]wgSection
+}
+
+// parseWireguardConfig reads a config as written by DumpWireguardConfig.
+// Comments and blank lines are dropped, as wg-quick does.
+func parseWireguardConfig(data []byte) (*wgQuickConfig, error) {
+	config := &wgQuickConfig{
+		Interface: make(wgSection),
+		Peers:     make(map[string]wgSection),
+	}
+
+	var section wgSection
+	peers := make([]wgSection, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		switch strings.ToLower(line) {
+		case "[interface]":
+			section = config.Interface
+			continue
+		case "[peer]":
+			section = make(wgSection)
+			peers = append(peers, section)
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 || section == nil {
+			return nil, fmt.Errorf("invalid line in config: %s", line)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		section[key] = append(section[key], value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, peer := range peers {
+		key := peer.get("publickey")
+		if key == "" {
+			return nil, fmt.Errorf("peer without a public key in config")
+		}
+		config.Peers[key] = peer
+	}
+	return config, nil
+}
+
+// allowedIPs lists the AllowedIPs of a peer section
+func (s wgSection) allowedIPs() []string {
+	cidrs := make([]string, 0)
+	for _, value := range s["allowedips"] {
+		for _, cidr := range strings.Split(value, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr != "" {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	}
+	return cidrs
+}
+
+// PeerChanges is the live update that takes a running mesh from one config to
+// another without restarting it
+type PeerChanges struct {
+	Added   int
+	Removed int
+	Updated int
+
+	config       wgtypes.Config
+	desired      *wgQuickConfig
+	addRoutes    []string
+	deleteRoutes []string
+}
+
+func (p *PeerChanges) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d updated", p.Added, p.Removed, p.Updated)
+}
+
+// DiffPeers compares the config a mesh is running with its new config.  It
+// returns false if the interface itself changed, or anything else that can't
+// be done live, in which case the mesh has to be restarted.
+func DiffPeers(running []byte, desired []byte) (*PeerChanges, bool) {
+	old, err := parseWireguardConfig(running)
+	if err != nil {
+		return nil, false
+	}
+	config, err := parseWireguardConfig(desired)
+	if err != nil {
+		return nil, false
+	}
+
+	// address, listen port, MTU, DNS, private key and hooks need a restart
+	if !reflect.DeepEqual(old.Interface, config.Interface) {
+		return nil, false
+	}
+
+	changes := &PeerChanges{desired: config}
+
+	keys := make([]string, 0, len(config.Peers))
+	for key := range config.Peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		peer := config.Peers[key]
+		previous, found := old.Peers[key]
+		if found && reflect.DeepEqual(previous, peer) {
+			continue
+		}
+
+		pc, err := peerConfig(key, peer)
+		if err != nil {
+			log.Errorf("Peer %s can't be updated live: %v", key, err)
+			return nil, false
+		}
+		if found {
+			changes.Updated++
+			// keep the endpoint the peer has roamed to unless meshify changed it
+			if previous.get("endpoint") == peer.get("endpoint") {
+				pc.Endpoint = nil
+			}
+		} else {
+			changes.Added++
+		}
+		changes.config.Peers = append(changes.config.Peers, pc)
+	}
+
+	keys = make([]string, 0, len(old.Peers))
+	for key := range old.Peers {
+		if _, found := config.Peers[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pk, err := wgtypes.ParseKey(key)
+		if err != nil {
+			return nil, false
+		}
+		changes.Removed++
+		changes.config.Peers = append(changes.config.Peers, wgtypes.PeerConfig{PublicKey: pk, Remove: true})
+	}
+
+	// wg-quick adds a route for every allowed IP unless the table is off
+	table := strings.ToLower(config.Interface.get("table"))
+	if table != "off" {
+		before := routeSet(old)
+		after := routeSet(config)
+		for cidr := range after {
+			if !before[cidr] {
+				changes.addRoutes = append(changes.addRoutes, cidr)
+			}
+		}
+		for cidr := range before {
+			if !after[cidr] {
+				changes.deleteRoutes = append(changes.deleteRoutes, cidr)
+			}
+		}
+		sort.Strings(changes.addRoutes)
+		sort.Strings(changes.deleteRoutes)
+
+		// routes in another table, a default route with the policy routing
+		// that comes with it, or any route where they can't be changed live,
+		// need the mesh restarted
+		if (!liveRoutes || (table != "" && table != "auto")) && len(changes.addRoutes)+len(changes.deleteRoutes) > 0 {
+			return nil, false
+		}
+		for _, cidr := range append(append([]string{}, changes.addRoutes...), changes.deleteRoutes...) {
+			if _, n, err := net.ParseCIDR(cidr); err == nil {
+				if ones, _ := n.Mask.Size(); ones == 0 {
+					return nil, false
+				}
+			}
+		}
+	}
+
+	return changes, true
+}
+
+// routeSet is every allowed IP of every peer, as the networks wg-quick routes
+func routeSet(config *wgQuickConfig) map[string]bool {
+	routes := make(map[string]bool)
+	for _, peer := range config.Peers {
+		for _, cidr := range peer.allowedIPs() {
+			_, n, err := net.ParseCIDR(cidr)
+			if err == nil {
+				routes[n.String()] = true
+			}
+		}
+	}
+	return routes
+}
+
+// peerConfig converts a peer section to the wgctrl equivalent
+func peerConfig(key string, peer wgSection) (wgtypes.PeerConfig, error) {
+	pc := wgtypes.PeerConfig{ReplaceAllowedIPs: true}
+
+	pk, err := wgtypes.ParseKey(key)
+	if err != nil {
+		return pc, err
+	}
+	pc.PublicKey = pk
+
+	// an empty preshared key clears it
+	psk := wgtypes.Key{}
+	if value := peer.get("presharedkey"); value != "" {
+		psk, err = wgtypes.ParseKey(value)
+		if err != nil {
+			return pc, fmt.Errorf("invalid preshared key: %v", err)
+		}
+	}
+	pc.PresharedKey = &psk
+
+	if value := peer.get("endpoint"); value != "" {
+		pc.Endpoint, err = net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			return pc, fmt.Errorf("invalid endpoint %s: %v", value, err)
+		}
+	}
+
+	keepalive := 0
+	if value := peer.get("persistentkeepalive"); value != "" && value != "off" {
+		keepalive, err = strconv.Atoi(value)
+		if err != nil {
+			return pc, fmt.Errorf("invalid persistent keepalive %s: %v", value, err)
+		}
+	}
+	interval := time.Duration(keepalive) * time.Second
+	pc.PersistentKeepaliveInterval = &interval
+
+	pc.AllowedIPs = make([]net.IPNet, 0)
+	for _, cidr := range peer.allowedIPs() {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return pc, fmt.Errorf("invalid allowed IP %s: %v", cidr, err)
+		}
+		pc.AllowedIPs = append(pc.AllowedIPs, *n)
+	}
+
+	return pc, nil
+}
+
+// Apply configures the running device and its routes
+func (p *PeerChanges) Apply(meshName string) error {
+	if len(p.config.Peers) > 0 {
+		wg, err := wgctrl.New()
+		if err != nil {
+			return err
+		}
+		defer wg.Close()
+
+		err = wg.ConfigureDevice(meshName, p.config)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, cidr := range p.deleteRoutes {
+		err := DeleteRoute(meshName, cidr)
+		if err != nil {
+			log.Errorf("Error deleting route %s from %s: %v", cidr, meshName, err)
+		}
+	}
+	for _, cidr := range p.addRoutes {
+		err := AddRoute(meshName, cidr)
+		if err != nil {
+			return fmt.Errorf("error adding route %s to %s: %v", cidr, meshName, err)
+		}
+	}
+
+	if len(p.config.Peers) > 0 {
+		log.Infof("Updated peers of %s: %s", meshName, p)
+	}
+	return nil
+}
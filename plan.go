@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meshify-app/meshify/model"
+)
+
+// DryRun prints what applying a config would do to this host, without
+// changing anything.  With no file the current config is fetched from meshify
+// for every identity, otherwise the file replaces the config of the identity
+// it belongs to.
+//
+//	meshify-client plan [file]
+func DryRun(args []string) error {
+	current := make(map[*Identity]model.Message)
+	next := make(map[*Identity]model.Message)
+	for _, id := range Identities() {
+		msg, err := id.LoadMessage()
+		if err == nil {
+			current[id] = msg
+			next[id] = msg
+		}
+	}
+	if len(Identities()) == 0 {
+		return fmt.Errorf("this host has not joined meshify")
+	}
+
+	if len(args) > 0 {
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		var msg model.Message
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", args[0], err)
+		}
+		id := messageOwner(msg)
+		if id == nil {
+			return fmt.Errorf("%s is not a config for this host", args[0])
+		}
+		next[id] = msg
+	} else {
+		normalizeHosts()
+		InitControllers()
+		for _, id := range Identities() {
+			msg, err := FetchMeshifyConfig(id)
+			if err != nil {
+				return fmt.Errorf("error getting the config for %s: %v", id, err)
+			}
+			next[id] = msg
+		}
+	}
+
+	load := func(messages map[*Identity]model.Message) func(id *Identity) (model.Message, error) {
+		return func(id *Identity) (model.Message, error) {
+			msg, found := messages[id]
+			if !found {
+				return msg, fmt.Errorf("no config for %s", id)
+			}
+			return msg, nil
+		}
+	}
+	before, _ := MergeMessages(load(current))
+	after, _ := MergeMessages(load(next))
+
+	applied := make(map[string]reconciledMesh)
+	for id, msg := range current {
+		rememberMeshes(applied, id, msg)
+	}
+
+	// the firewalls, routing and exit nodes are compared with what the agent
+	// has applied.  With no agent running there is nothing, as for an agent
+	// that is starting.
+	state, reached, err := fetchAppliedState("http://127.0.0.1:53280/applied/")
+	if reached && err != nil {
+		return fmt.Errorf("error asking the agent what it has applied: %v", err)
+	}
+	if reached {
+		useAppliedState(state)
+	}
+
+	desired := DesiredStateFor(after)
+	markRejected(desired)
+	observed := ObservedState(desired, applied)
+	actions := Plan(desired, observed, applied)
+
+	// name peers by host rather than public key where we can
+	names := make(map[string]string)
+	for _, msg := range []model.Message{before, after} {
+		for _, mesh := range msg.Config {
+			for _, host := range mesh.Hosts {
+				names[host.Current.PublicKey] = host.Name
+			}
+		}
+	}
+
+	if len(actions) == 0 {
+		fmt.Println("No changes to the meshes")
+	}
+	for _, action := range actions {
+		fmt.Println(action)
+		o := observed[action.MeshName]
+		if action.mesh == nil || o == nil || o.Config == nil {
+			continue
+		}
+		switch action.Type {
+		case ActionUp, ActionPeers, ActionDown:
+			added, removed, updated := peerDiff(o.Config, action.mesh.Config)
+			printNames("  peers added:", added, names)
+			printNames("  peers removed:", removed, names)
+			printNames("  peers changed:", updated, names)
+		}
+	}
+
+	for _, d := range desired {
+		if d.Err != nil {
+			fmt.Printf("%s can't be applied: %v\n", d.MeshName, d.Err)
+		}
+		if len(d.Overrides) > 0 {
+			fmt.Printf("%s local overrides: %s\n", d.MeshName, strings.Join(d.Overrides, ", "))
+		}
+	}
+
+	oldNames := dnsNames(before)
+	newNames := dnsNames(after)
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	for name := range newNames {
+		if !oldNames[name] {
+			added = append(added, name)
+		}
+	}
+	for name := range oldNames {
+		if !newNames[name] {
+			removed = append(removed, name)
+		}
+	}
+	printNames("DNS names added:", added, nil)
+	printNames("DNS names removed:", removed, nil)
+
+	return nil
+}
+
+// AppliedState is what the agent has set up for each mesh besides wireguard,
+// as the signatures of what SetFirewall, SetSubnetRouting and SetExitNode
+// were last called with.  Plan needs it to tell what the agent would change.
+type AppliedState struct {
+	Firewalls map[string]string `json:"firewalls"`
+	Routing   map[string]string `json:"routing"`
+	ExitNodes map[string]string `json:"exitNodes"`
+}
+
+// CurrentAppliedState is what this process has applied
+func CurrentAppliedState() AppliedState {
+	copyState := func(lock *sync.Mutex, state map[string]string) map[string]string {
+		lock.Lock()
+		defer lock.Unlock()
+
+		result := make(map[string]string, len(state))
+		for mesh, signature := range state {
+			result[mesh] = signature
+		}
+		return result
+	}
+	return AppliedState{
+		Firewalls: copyState(&firewallLock, firewalls),
+		Routing:   copyState(&routingLock, routing),
+		ExitNodes: copyState(&exitNodeLock, exitNodes),
+	}
+}
+
+// useAppliedState makes Plan compare with what the agent has applied
+func useAppliedState(state AppliedState) {
+	useState := func(lock *sync.Mutex, current *map[string]string, state map[string]string) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		*current = make(map[string]string, len(state))
+		for mesh, signature := range state {
+			(*current)[mesh] = signature
+		}
+	}
+	useState(&firewallLock, &firewalls, state.Firewalls)
+	useState(&routingLock, &routing, state.Routing)
+	useState(&exitNodeLock, &exitNodes, state.ExitNodes)
+}
+
+// fetchAppliedState asks the running agent what it has applied.  reached is
+// false if there is no agent running.
+func fetchAppliedState(url string) (state AppliedState, reached bool, err error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return state, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return state, true, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, true, err
+}
+
+// messageOwner returns the identity a message from meshify was sent to
+func messageOwner(msg model.Message) *Identity {
+	for _, mesh := range msg.Config {
+		for _, host := range mesh.Hosts {
+			if id := IdentityFor(host.HostGroup); id != nil {
+				return id
+			}
+		}
+	}
+	return nil
+}
+
+// peerDiff lists the public keys of the peers added, removed and changed
+// between two wireguard configs
+func peerDiff(running []byte, desired []byte) ([]string, []string, []string) {
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	updated := make([]string, 0)
+
+	old, err := parseWireguardConfig(running)
+	if err != nil {
+		return added, removed, updated
+	}
+	config, err := parseWireguardConfig(desired)
+	if err != nil {
+		return added, removed, updated
+	}
+
+	for key, peer := range config.Peers {
+		previous, found := old.Peers[key]
+		if !found {
+			added = append(added, key)
+		} else if !reflect.DeepEqual(previous, peer) {
+			updated = append(updated, key)
+		}
+	}
+	for key := range old.Peers {
+		if _, found := config.Peers[key]; !found {
+			removed = append(removed, key)
+		}
+	}
+	return added, removed, updated
+}
+
+// dnsNames are the host names the DNS server answers for a message
+func dnsNames(msg model.Message) map[string]bool {
+	names := make(map[string]bool)
+	table, _, err := BuildDNSTables(msg)
+	if err != nil {
+		return names
+	}
+	for name := range table {
+		if !strings.HasSuffix(name, ".in-addr.arpa") {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func printNames(title string, keys []string, names map[string]string) {
+	if len(keys) == 0 {
+		return
+	}
+	list := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if name, found := names[key]; found && name != "" {
+			list = append(list, name)
+		} else {
+			list = append(list, key)
+		}
+	}
+	sort.Strings(list)
+	fmt.Println(title, strings.Join(list, ", "))
+}
+
+// FetchMeshifyConfig gets the current config of an identity from meshify,
+// without saving it or changing any state
+func FetchMeshifyConfig(id *Identity) (model.Message, error) {
+	var msg model.Message
+	ctl := id.Controllers().Active()
+
+	client, err := HTTPClient()
+	if err != nil {
+		return msg, err
+	}
+
+	var reqURL string = fmt.Sprintf(meshifyHostAPIFmt, ctl.URL, id.HostID)
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return msg, err
+	}
+	req.Header.Set("X-API-KEY", id.ApiKey)
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return msg, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return msg, NewAPIError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return msg, err
+	}
+
+	err = VerifyMessage(id, body, resp.Header.Get(signatureHeader))
+	if err != nil {
+		return msg, err
+	}
+
+	err = json.Unmarshal(body, &msg)
+	return msg, err
+}
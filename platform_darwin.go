@@ -1,12 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/meshify-app/meshify/model"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -23,55 +28,73 @@ func Platform() string {
 	return "MacOS"
 }
 
-func GetStats(mesh string) (string, error) {
-	args := []string{"wg", "show", mesh, "transfer"}
+// The driver used unless the config picks another, and the shell wg-quick
+// runs in, since wg-quick needs a newer bash than macOS has
+const (
+	defaultDriver = "wg-quick"
+	bashPath      = "/usr/local/bin/bash"
+)
 
-	out, err := exec.Command("/usr/local/bin/bash", args...).Output()
-	if err != nil {
-		log.Errorf("Error getting statistics: %v (%s)", err, string(out))
-		return "", err
-	}
+// liveRoutes is false as routes are not changed live on macOS, where the
+// interface is a utun device named by wg-quick, so the mesh is restarted instead
+const liveRoutes = false
 
-	return string(out), nil
+// AddRoute is never called, see liveRoutes
+func AddRoute(meshName string, cidr string) error {
+	return errors.New("routes are managed by wg-quick on macOS")
 }
 
-func Startireguard(meshName string) error {
-
-	args := []string{"wg-quick", "up", meshName}
-
-	cmd := exec.Command("/usr/local/bin/bash", args...)
-	cmd.Stderr = &out
-	go func() {
-		err := cmd.Run()
-	}()
+// DeleteRoute, see AddRoute
+func DeleteRoute(meshName string, cidr string) error {
+	return errors.New("routes are managed by wg-quick on macOS")
+}
 
+// DefaultGateway is the IPv4 router of the default route, which port
+// mapping requests go to
+func DefaultGateway() (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
 	if err != nil {
-		log.Errorf("Error reloading WireGuard: %v (%s)", err, out.String())
-		return err
+		return nil, err
 	}
-
-	return err
-
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			if ip := net.ParseIP(fields[1]).To4(); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no default gateway")
 }
-func StopWireguard(meshName string) error {
 
-	args := []string{"wg-quick", "down", meshName}
-
-	cmd := exec.Command("/usr/local/bin/bash", args...)
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("Error reloading WireGuard: %v (%s)", err, out.String())
+// SetSubnetRouting is not done on macOS
+func SetSubnetRouting(meshName string, sources []string, routes []string) error {
+	if len(routes) > 0 {
+		return fmt.Errorf("subnet routing is not supported on %s", Platform())
 	}
-	// remove the file if it exists
-	path := GetWireguardPath() + meshName + ".conf"
-	if _, err := os.Stat(path); err == nil {
-		os.Remove(path)
+	return nil
+}
+
+// SetExitNode only has wg-quick's default route on macOS
+func SetExitNode(meshName string, exit *ExitNode) error {
+	if exit != nil && (exit.BlockLAN || exit.KillSwitch) {
+		return fmt.Errorf("exit node LAN blocking and kill switch are not supported on %s", Platform())
 	}
+	return nil
+}
 
-	return err
+// SetFirewall is not done on macOS.  The ACLs are not enforced, which is
+// logged once for each change rather than failing every reconcile.
+func SetFirewall(meshName string, acls []ACL) error {
+	if acls != nil {
+		log.Errorf("Mesh firewalls are not supported on %s, the %d ACLs of %s are not enforced", Platform(), len(acls), meshName)
+	}
+	return nil
+}
 
+// adoptTables has nothing to take over, as there are no tables here
+func adoptTables(desired []*DesiredMesh) error {
+	return nil
 }
 
 func StartContainer(service model.Service) (string, error) {
@@ -91,8 +114,8 @@ func InService() (bool, error) {
 }
 
 func RunService(svcName string) {
-	DoWork()
-	DoServiceWork()
+	agent := StartAgent(context.Background())
+	DoServiceWork(agent)
 
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
@@ -106,6 +129,7 @@ func RunService(svcName string) {
 
 	<-done
 
+	StopAgent(agent)
 	log.Info("Exiting")
 
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -11,14 +13,22 @@ import (
 
 	"github.com/meshify-app/meshify/model"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Where the wireguard configs and our own files are kept.  Tests point them
+// at a temporary directory.
+var (
+	wireguardPath = "/etc/wireguard/"
+	dataPath      = "/etc/meshify/"
 )
 
 func GetWireguardPath() string {
-	return "/etc/wireguard/"
+	return wireguardPath
 }
 
 func GetDataPath() string {
-	return "/etc/meshify/"
+	return dataPath
 }
 
 // Return the platform
@@ -26,55 +36,58 @@ func Platform() string {
 	return "Linux"
 }
 
-func GetStats(mesh string) (string, error) {
-	args := []string{"show", mesh, "transfer"}
+// The driver used unless the config picks another, and the shell wg-quick runs in
+const (
+	defaultDriver = "netlink"
+	bashPath      = "/bin/bash"
+)
+
+// liveRoutes is true as AddRoute and DeleteRoute work on a running mesh
+const liveRoutes = true
 
-	out, err := exec.Command("wg", args...).Output()
+// AddRoute routes a network to the mesh interface, as wg-quick does for allowed IPs
+func AddRoute(meshName string, cidr string) error {
+	route, err := meshRoute(meshName, cidr)
 	if err != nil {
-		log.Errorf("Error getting statistics: %v (%s)", err, string(out))
-		return "", err
+		return err
 	}
-
-	return string(out), nil
+	return netlink.RouteReplace(route)
 }
 
-func StartWireguard(meshName string) error {
-
-	args := []string{"wg-quick", "up", meshName}
-
-	cmd := exec.Command("/bin/bash", args...)
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	err := cmd.Run()
+// DeleteRoute removes a route added by AddRoute
+func DeleteRoute(meshName string, cidr string) error {
+	route, err := meshRoute(meshName, cidr)
 	if err != nil {
-		log.Errorf("Error starting WireGuard: %v (%s)", err, out.String())
 		return err
 	}
-
-	return err
-
+	return netlink.RouteDel(route)
 }
 
-func StopWireguard(meshName string) error {
-
-	args := []string{"wg-quick", "down", meshName}
-
-	cmd := exec.Command("/bin/bash", args...)
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	err := cmd.Run()
+// DefaultGateway is the IPv4 router of the default route, which port
+// mapping requests go to
+func DefaultGateway() (net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
 	if err != nil {
-		log.Errorf("Error stopping WireGuard: %v (%s)", err, out.String())
+		return nil, err
 	}
-
-	// remove the file if it exists
-	path := GetWireguardPath() + meshName + ".conf"
-	if _, err := os.Stat(path); err == nil {
-		os.Remove(path)
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			return route.Gw, nil
+		}
 	}
+	return nil, fmt.Errorf("no default gateway")
+}
 
-	return err
-
+func meshRoute(meshName string, cidr string) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(meshName)
+	if err != nil {
+		return nil, err
+	}
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}, nil
 }
 
 // docker run -e MESHIFY_HOST_ID=715d2d3d-2eb2-4f06-be90-4e8d679360a5 -e MESHIFY_API_KEY=example -p 40000:40000 meshify-client
@@ -163,8 +176,8 @@ func InService() (bool, error) {
 
 func RunService(svcName string) {
 
-	DoWork()
-	DoServiceWork()
+	agent := StartAgent(context.Background())
+	DoServiceWork(agent)
 
 	log.Info("setting up signal handlers")
 	sigs := make(chan os.Signal, 1)
@@ -179,6 +192,7 @@ func RunService(svcName string) {
 
 	<-done
 
+	StopAgent(agent)
 	log.Info("Exiting")
 	os.Exit(0)
 
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/meshify-app/meshify/model"
@@ -37,18 +39,27 @@ func Platform() string {
 	return "Windows"
 }
 
-func GetStats(mesh string) (string, error) {
+// The driver used unless the config picks another
+const defaultDriver = "service"
+
+// serviceDriver runs each mesh as a tunnel service of the WireGuard app
+type serviceDriver struct{}
+
+func init() {
+	RegisterDriver("service", serviceDriver{})
+}
+
+func (serviceDriver) Stats(mesh string) (string, error) {
 	args := []string{"show", mesh, "transfer"}
 	out, err := exec.Command("wg.exe", args...).Output()
 	if err != nil {
-		log.Errorf("Error getting stats: %v (%s)", err, string(out))
-		return "", err
+		return "", fmt.Errorf("%v (%s)", err, string(out))
 	}
 	return string(out), nil
 }
 
-// StartWireguard restarts the wireguard tunnel on the given platform
-func StartWireguard(meshName string) error {
+// Up installs the tunnel service of a mesh
+func (serviceDriver) Up(meshName string, conf []byte) error {
 
 	time.Sleep(1 * time.Second)
 
@@ -59,16 +70,15 @@ func StartWireguard(meshName string) error {
 	cmd.Stderr = &out
 	err := cmd.Run()
 	if err != nil {
-		log.Errorf("Error starting WireGuard: %v (%s)", err, out.String())
-		return err
+		return fmt.Errorf("%v (%s)", err, out.String())
 	}
 
 	return nil
 
 }
 
-// StopWireguard stops the wireguard tunnel on the given platform
-func StopWireguard(meshName string) error {
+// Down uninstalls the tunnel service of a mesh
+func (serviceDriver) Down(meshName string) error {
 
 	args := []string{"/uninstalltunnelservice", meshName}
 
@@ -80,23 +90,102 @@ func StopWireguard(meshName string) error {
 	cmd.Stderr = &out
 	err := cmd.Start()
 	if err != nil {
-		log.Errorf("Error stopping WireGuard: %v (%s)", err, out.String())
+		return fmt.Errorf("%v (%s)", err, out.String())
 	}
 	log.Info(out.String())
 
 	err = cmd.Wait()
 	if err != nil {
-		log.Errorf("Error stopping WireGuard: %v (%s)", err, out.String())
+		return fmt.Errorf("%v (%s)", err, out.String())
 	}
 
-	// remove the file if it exists
-	path := GetWireguardPath() + meshName + ".conf"
-	if _, err := os.Stat(path); err == nil {
-		os.Remove(path)
+	return nil
+
+}
+
+func (serviceDriver) ApplyPeers(meshName string, changes *PeerChanges) error {
+	return changes.Apply(meshName)
+}
+
+func (serviceDriver) Interfaces() ([]string, error) {
+	return wgctrlInterfaces()
+}
+
+// liveRoutes is true as AddRoute and DeleteRoute work on a running mesh
+const liveRoutes = true
+
+// AddRoute routes a network to the mesh interface, as the tunnel service does for allowed IPs
+func AddRoute(meshName string, cidr string) error {
+	return netshRoute("add", meshName, cidr)
+}
+
+// DeleteRoute removes a route added by AddRoute
+func DeleteRoute(meshName string, cidr string) error {
+	return netshRoute("delete", meshName, cidr)
+}
+
+// DefaultGateway is the IPv4 router of the default route, which port
+// mapping requests go to
+func DefaultGateway() (net.IP, error) {
+	out, err := exec.Command("powershell.exe", "-NoProfile", "-Command",
+		"(Get-NetRoute -DestinationPrefix 0.0.0.0/0 | Sort-Object RouteMetric | Select-Object -First 1).NextHop").Output()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(out))).To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil, fmt.Errorf("no default gateway")
 	}
+	return ip, nil
+}
 
-	return err
+// SetSubnetRouting is not done on Windows, where forwarding and NAT are set
+// up with Internet Connection Sharing by hand
+func SetSubnetRouting(meshName string, sources []string, routes []string) error {
+	if len(routes) > 0 {
+		return fmt.Errorf("subnet routing is not supported on %s", Platform())
+	}
+	return nil
+}
+
+// SetExitNode is not done on Windows, where the tunnel service routes
+// everything through a peer with 0.0.0.0/0 on its own
+func SetExitNode(meshName string, exit *ExitNode) error {
+	if exit != nil && (exit.BlockLAN || exit.KillSwitch) {
+		return fmt.Errorf("exit node LAN blocking and kill switch are not supported on %s", Platform())
+	}
+	return nil
+}
+
+// SetFirewall is not done on Windows.  The ACLs are not enforced, which is
+// logged once for each change rather than failing every reconcile.
+func SetFirewall(meshName string, acls []ACL) error {
+	if acls != nil {
+		log.Errorf("Mesh firewalls are not supported on %s, the %d ACLs of %s are not enforced", Platform(), len(acls), meshName)
+	}
+	return nil
+}
 
+// adoptTables has nothing to take over, as there are no tables here
+func adoptTables(desired []*DesiredMesh) error {
+	return nil
+}
+
+func netshRoute(verb string, meshName string, cidr string) error {
+	family := "ipv4"
+	if strings.Contains(cidr, ":") {
+		family = "ipv6"
+	}
+	args := []string{"interface", family, verb, "route", "prefix=" + cidr, "interface=" + meshName, "store=active"}
+
+	var out bytes.Buffer
+	cmd := exec.Command("netsh.exe", args...)
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v (%s)", err, strings.TrimSpace(out.String()))
+	}
+	return nil
 }
 
 func StartContainer(service model.Service) (string, error) {
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long port mappings are asked for, and how often they are checked.  A
+// mapping is renewed once half its lease has gone, which the gateway may
+// have made shorter than we asked.
+const (
+	portMappingLifetime = 2 * time.Hour
+	portMappingCheck    = time.Minute
+)
+
+// PortMapping is a port the gateway forwards to this host
+type PortMapping struct {
+	MeshName     string        `json:"meshName"`
+	Protocol     string        `json:"protocol"`
+	Gateway      string        `json:"gateway"`
+	Description  string        `json:"description"`
+	InternalPort uint16        `json:"internalPort"`
+	ExternalPort uint16        `json:"externalPort"`
+	ExternalIP   string        `json:"externalIP,omitempty"`
+	Lifetime     time.Duration `json:"lifetime"`
+	Expires      time.Time     `json:"expires"`
+	Nonce        []byte        `json:"nonce,omitempty"`
+}
+
+// permanent is true for a UPnP mapping on a gateway that only has
+// permanent leases, which is never renewed
+func (m *PortMapping) permanent() bool {
+	return m.Lifetime == 0
+}
+
+func (m *PortMapping) expired() bool {
+	return !m.permanent() && time.Now().After(m.Expires)
+}
+
+// PortMapper asks the gateway to forward a UDP port.  The gateway may pick
+// another external port or a shorter lifetime than asked for.
+type PortMapper interface {
+	Protocol() string
+	ExternalAddress() (net.IP, error)
+	MapPort(port uint16, lifetime time.Duration, description string) (*PortMapping, error)
+	Renew(mapping *PortMapping, lifetime time.Duration) (*PortMapping, error)
+	UnmapPort(mapping *PortMapping) error
+}
+
+// portMappings are the port mappings we have added, by description, which
+// are kept in PortMappingsPath so they can be removed after a restart.
+// portMapper is the mapper found for the gateway, kept for renewals.
+// meshMappingLocks keep the changes to the mappings of each mesh, which talk
+// to the gateway, from running at the same time.
+var (
+	portMappings       = make(map[string]*PortMapping)
+	portMappingsLoaded bool
+	portMapper         PortMapper
+	portMapperFor      string
+	meshMappingLocks   = make(map[string]*sync.Mutex)
+	portMappingsLock   sync.Mutex
+)
+
+// meshMappingLock is the lock held while the mappings of a mesh are changed
+func meshMappingLock(meshName string) *sync.Mutex {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+
+	lock, found := meshMappingLocks[meshName]
+	if !found {
+		lock = &sync.Mutex{}
+		meshMappingLocks[meshName] = lock
+	}
+	return lock
+}
+
+// PortMappingsPath is the file of the port mappings the agent has added
+func PortMappingsPath() string {
+	return GetDataPath() + "portmappings.json"
+}
+
+// ReadPortMappings reads the port mappings from PortMappingsPath
+func ReadPortMappings() ([]*PortMapping, error) {
+	mappings := make([]*PortMapping, 0)
+	data, err := ioutil.ReadFile(PortMappingsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return mappings, err
+	}
+	err = json.Unmarshal(data, &mappings)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", PortMappingsPath(), err)
+	}
+	return mappings, nil
+}
+
+// loadPortMappings reads the port mappings the first time they are needed.
+// Call with portMappingsLock held.
+func loadPortMappings() {
+	if portMappingsLoaded {
+		return
+	}
+	portMappingsLoaded = true
+
+	mappings, err := ReadPortMappings()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, mapping := range mappings {
+		portMappings[mapping.Description] = mapping
+	}
+}
+
+// savePortMappings writes the port mappings.  Call with portMappingsLock held.
+func savePortMappings() {
+	mappings := make([]*PortMapping, 0, len(portMappings))
+	for _, mapping := range portMappings {
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Description < mappings[j].Description })
+
+	data, err := json.MarshalIndent(mappings, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(PortMappingsPath(), data, 0600)
+	}
+	if err != nil {
+		log.Errorf("Error saving port mappings: %v", err)
+	}
+}
+
+func setPortMapping(mapping *PortMapping) {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+
+	loadPortMappings()
+	portMappings[mapping.Description] = mapping
+	savePortMappings()
+}
+
+func forgetPortMapping(description string) {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+
+	loadPortMappings()
+	delete(portMappings, description)
+	savePortMappings()
+}
+
+// meshPortMappings lists the port mappings of a mesh, or of every mesh for ""
+func meshPortMappings(meshName string) []*PortMapping {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+
+	loadPortMappings()
+	mappings := make([]*PortMapping, 0)
+	for _, mapping := range portMappings {
+		if meshName == "" || mapping.MeshName == meshName {
+			mappings = append(mappings, mapping)
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Description < mappings[j].Description })
+	return mappings
+}
+
+// PortMappedMeshes lists the meshes that have port mappings
+func PortMappedMeshes() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, mapping := range meshPortMappings("") {
+		if !seen[mapping.MeshName] {
+			seen[mapping.MeshName] = true
+			names = append(names, mapping.MeshName)
+		}
+	}
+	return names
+}
+
+// localAddressTo is the address of this host on the way to the gateway,
+// which the gateway forwards to
+func localAddressTo(gateway net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// discoverPortMapper tries PCP, NAT-PMP and UPnP in turn on the default
+// gateway, reusing the mapper found before if the gateway has not changed
+func discoverPortMapper() (PortMapper, string, error) {
+	gateway, err := DefaultGateway()
+	if err != nil {
+		return nil, "", err
+	}
+	local, err := localAddressTo(gateway)
+	if err != nil {
+		return nil, "", err
+	}
+
+	portMappingsLock.Lock()
+	if portMapper != nil && portMapperFor == gateway.String() {
+		defer portMappingsLock.Unlock()
+		return portMapper, portMapperFor, nil
+	}
+	portMappingsLock.Unlock()
+
+	discover := []struct {
+		protocol string
+		new      func() (PortMapper, error)
+	}{
+		{"PCP", func() (PortMapper, error) { return newPCPMapper(gateway, local) }},
+		{"NAT-PMP", func() (PortMapper, error) { return newNATPMPMapper(gateway) }},
+		{"UPnP", func() (PortMapper, error) { return newUPnPMapper(local) }},
+	}
+	var mapper PortMapper
+	errs := make([]string, 0, len(discover))
+	for _, d := range discover {
+		mapper, err = d.new()
+		if err == nil {
+			break
+		}
+		errs = append(errs, d.protocol+": "+err.Error())
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("no port mapping on gateway %s (%s)", gateway, strings.Join(errs, ", "))
+	}
+	log.Infof("Mapping ports with %s on gateway %s", mapper.Protocol(), gateway)
+
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+	portMapper = mapper
+	portMapperFor = gateway.String()
+	return mapper, portMapperFor, nil
+}
+
+// forgetPortMapper makes the next mapping look for the gateway again
+func forgetPortMapper() {
+	portMappingsLock.Lock()
+	defer portMappingsLock.Unlock()
+
+	portMapper = nil
+	portMapperFor = ""
+}
+
+// mapperOf finds the mapper that made a mapping, which is gone if we have
+// moved to another gateway
+func mapperOf(mapping *PortMapping) (PortMapper, error) {
+	mapper, gateway, err := discoverPortMapper()
+	if err != nil {
+		return nil, err
+	}
+	if gateway != mapping.Gateway || mapper.Protocol() != mapping.Protocol {
+		return nil, fmt.Errorf("%s gateway %s is no longer ours", mapping.Protocol, mapping.Gateway)
+	}
+	return mapper, nil
+}
+
+// granted fills in what we keep of a mapping the gateway has granted
+func granted(mapping *PortMapping, meshName string, gateway string) *PortMapping {
+	mapping.MeshName = meshName
+	mapping.Gateway = gateway
+	mapping.Expires = time.Time{}
+	if !mapping.permanent() {
+		mapping.Expires = time.Now().Add(mapping.Lifetime)
+	}
+	return mapping
+}
+
+// renewPortMapping extends the lease of a mapping
+func renewPortMapping(mapping *PortMapping) (*PortMapping, error) {
+	mapper, err := mapperOf(mapping)
+	if err != nil {
+		return nil, err
+	}
+	renewed, err := mapper.Renew(mapping, portMappingLifetime)
+	if err != nil {
+		forgetPortMapper()
+		return nil, err
+	}
+	renewed = granted(renewed, mapping.MeshName, mapping.Gateway)
+	setPortMapping(renewed)
+	return renewed, nil
+}
+
+// removePortMapping deletes a mapping from the gateway.  It is forgotten
+// even if that fails, as the lease will run out.
+func removePortMapping(mapping *PortMapping) error {
+	defer forgetPortMapping(mapping.Description)
+
+	if mapping.expired() {
+		return nil
+	}
+	mapper, err := mapperOf(mapping)
+	if err != nil {
+		return err
+	}
+	log.Infof("Removing %s port mapping %s", mapping.Protocol, mapping.Description)
+	return mapper.UnmapPort(mapping)
+}
+
+// RemoveMeshPortMappings deletes the port mappings of a mesh whose host no
+// longer wants UPnP, or that has gone
+func RemoveMeshPortMappings(meshName string) error {
+	lock := meshMappingLock(meshName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var lastErr error
+	for _, mapping := range meshPortMappings(meshName) {
+		err := removePortMapping(mapping)
+		if err != nil {
+			log.Errorf("Error deleting port mapping %s: %v", mapping.Description, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// RemovePortMappings deletes every port mapping the agent added, a mesh at
+// a time so it never races with a mesh changing its own
+func RemovePortMappings(ctx context.Context) error {
+	var lastErr error
+	for _, meshName := range PortMappedMeshes() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := RemoveMeshPortMappings(meshName)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// StartPortMappingRenewal renews the port mappings before their leases run out
+func StartPortMappingRenewal(ctx context.Context) error {
+	for {
+		if !sleepContext(ctx, portMappingCheck) {
+			return nil
+		}
+		for _, mapping := range meshPortMappings("") {
+			if mapping.permanent() || time.Until(mapping.Expires) > mapping.Lifetime/2 {
+				continue
+			}
+			renewMeshPortMapping(mapping)
+		}
+	}
+}
+
+// renewMeshPortMapping renews a mapping unless the mesh has replaced or
+// removed it since it was listed
+func renewMeshPortMapping(mapping *PortMapping) {
+	lock := meshMappingLock(mapping.MeshName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current := false
+	for _, m := range meshPortMappings(mapping.MeshName) {
+		current = current || m == mapping
+	}
+	if !current {
+		return
+	}
+
+	_, err := renewPortMapping(mapping)
+	if err != nil {
+		log.Errorf("Error renewing port mapping %s: %v", mapping.Description, err)
+		if mapping.expired() {
+			forgetPortMapping(mapping.Description)
+		}
+	}
+}
+
+// ConfigureUPnP maps the listen port of a host on the gateway, with whichever
+// of PCP, NAT-PMP and UPnP it has, and updates the endpoint at meshify if the
+// gateway's external address or port differ from it.  A mapping we have is
+// left to StartPortMappingRenewal.  host is as meshify has it, which is what
+// goes back with the new endpoint, and listenPort the port wireguard is on
+// here, which a local override may have changed.
+func ConfigureUPnP(host model.Host, listenPort int) error {
+	if !host.Current.UPnP || listenPort == 0 || host.Current.Endpoint == "" {
+		return nil
+	}
+
+	lock := meshMappingLock(host.MeshName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	log.Infof("***UPNP*** Configuring port mapping for %s", host.Name)
+	mapper, gateway, err := discoverPortMapper()
+	if err != nil {
+		log.Errorf("Port mapping not supported: %v", err)
+		return err
+	}
+
+	// keep the mapping we have, unless the port or gateway have changed
+	port := uint16(listenPort)
+	description := host.Name + "-" + host.MeshName
+	var mapping *PortMapping
+	for _, m := range meshPortMappings(host.MeshName) {
+		if m.Description == description && m.InternalPort == port && m.Gateway == gateway && m.Protocol == mapper.Protocol() && !m.expired() {
+			mapping = m
+		} else {
+			removePortMapping(m)
+		}
+	}
+
+	if mapping == nil {
+		mapping, err = mapper.MapPort(port, portMappingLifetime, description)
+		if err != nil {
+			// the gateway may have changed under us
+			forgetPortMapper()
+			log.Errorf("Error adding %s port mapping: %v", mapper.Protocol(), err)
+			return err
+		}
+		mapping = granted(mapping, host.MeshName, gateway)
+		setPortMapping(mapping)
+	}
+	log.Infof("***UPNP*** %s mapped port %d to %d for %v", mapping.Protocol, mapping.InternalPort, mapping.ExternalPort, mapping.Lifetime)
+
+	externalIP := net.ParseIP(mapping.ExternalIP)
+	if externalIP == nil {
+		externalIP, err = mapper.ExternalAddress()
+		if err != nil {
+			log.Errorf("Error getting external ip address: %v", err)
+			return err
+		}
+	}
+	log.Infof("***UPNP*** External IP address: %s", externalIP)
+
+	// compare the external address to the endpoint
+	endpoint := net.JoinHostPort(externalIP.String(), strconv.Itoa(int(mapping.ExternalPort)))
+	if endpoint != host.Current.Endpoint && !isBogon(externalIP.String()) {
+		log.Infof("Updating endpoint of %s from %s to %s", host.MeshName, host.Current.Endpoint, endpoint)
+		host.Current.Endpoint = endpoint
+		return UpdateMeshifyHost(host)
+	}
+	return nil
+}
+
+// UPnPCommand runs the upnp commands
+//
+//	meshify-client upnp list
+func UPnPCommand(args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return errors.New("usage: meshify-client upnp list")
+	}
+
+	mappings, err := ReadPortMappings()
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		fmt.Println("No port mappings")
+	}
+	for _, m := range mappings {
+		state := "expires " + m.Expires.Local().Format("2006-01-02 15:04:05")
+		if m.permanent() {
+			state = "permanent"
+		} else if m.expired() {
+			state = "expired"
+		}
+		external := strconv.Itoa(int(m.ExternalPort))
+		if m.ExternalIP != "" {
+			external = net.JoinHostPort(m.ExternalIP, external)
+		}
+		fmt.Printf("%-20s %-8s %-16s %5d -> %-22s %s\n", m.MeshName, m.Protocol, m.Gateway, m.InternalPort, external, state)
+	}
+	return nil
+}
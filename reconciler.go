@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meshify-app/meshify/model"
+	util "github.com/meshify-app/meshify/util"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How often to look for address changes on the local interfaces
+const networkWatchInterval = 30 * time.Second
+
+// ActionType is one kind of change the reconciler makes to a mesh
+type ActionType string
+
+const (
+	ActionKey    ActionType = "key"    // store the private key, publishing the public key if we generated it
+	ActionUPnP   ActionType = "upnp"   // map the listen port on the gateway
+	ActionSTUN   ActionType = "stun"   // find the public endpoint with STUN
+	ActionUnmap  ActionType = "unmap"  // remove the port mappings of a mesh
+	ActionUp     ActionType = "up"     // write the wireguard config and restart the mesh
+	ActionPeers  ActionType = "peers"  // write the wireguard config and update the peers of the running mesh
+	ActionStart  ActionType = "start"  // start a mesh whose config is already in place
+	ActionRoutes ActionType = "routes" // forward the subnet routes and report them to meshify
+	ActionExit   ActionType = "exit"   // set up the LAN rules and kill switch of an exit node
+	ActionACL    ActionType = "acl"    // replace the firewall that limits what peers can reach
+	ActionDown   ActionType = "down"   // write the config of a disabled mesh and stop it
+	ActionDelete ActionType = "delete" // stop a mesh that is no longer configured and forget its key
+)
+
+// Action is one step of a reconcile
+type Action struct {
+	Type     ActionType `json:"type"`
+	MeshName string     `json:"meshName"`
+	Reason   string     `json:"reason"`
+
+	mesh     *DesiredMesh
+	identity *Identity
+	key      string
+	peers    *PeerChanges
+	previous []byte
+}
+
+func (a Action) String() string {
+	return fmt.Sprintf("%s %s (%s)", a.Type, a.MeshName, a.Reason)
+}
+
+// DesiredMesh is a mesh as meshify says it should be on this host
+type DesiredMesh struct {
+	MeshName string
+	Identity *Identity
+	Host     model.Host
+	Peers    []model.Host
+	Config   []byte
+	Err      error
+
+	// Local is Host with the local overrides, which are listed in Overrides.
+	// Host is what meshify sent, and is what goes back to it.
+	Local     model.Host
+	Overrides []string
+
+	// Routes are the local subnets to advertise into the mesh, and
+	// AdvertisedRoutes those meshify was last told about
+	Routes           []string
+	AdvertisedRoutes []string
+
+	// Forward is what is forwarded from the mesh: the routes, and everything
+	// when we are an exit node.  ExitNode is the peer we send everything to.
+	Forward  []string
+	ExitNode *ExitNode
+
+	// ACLs are what peers may reach on this host, nil for anything
+	ACLs []ACL
+
+	// StoreKey is set when the private key came from meshify and is not in
+	// the key store, and NewKey when we had none and generated one
+	StoreKey     bool
+	NewKey       bool
+	OldPublicKey string
+}
+
+// ObservedMesh is a mesh as it is on this host
+type ObservedMesh struct {
+	MeshName string
+	Config   []byte
+	Up       bool
+}
+
+// reconciledMesh is what we remember about a mesh we have applied, so it can
+// be removed once meshify no longer sends it
+type reconciledMesh struct {
+	identity  *Identity
+	publicKey string
+}
+
+var (
+	reconciled    = make(map[string]reconciledMesh)
+	reconcileLock sync.Mutex
+
+	// tablesAdopted is set once the first reconcile has taken over what a
+	// previous run left behind
+	tablesAdopted bool
+)
+
+// Reconcile brings the meshes on this host in line with the last config from
+// meshify.  It is called for a new config, the hourly refresh, a change to
+// the local network and from the local API.
+func Reconcile(ctx context.Context, reason string) ([]Action, error) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	desired, err := DesiredState()
+	if err != nil {
+		return nil, err
+	}
+	markRejected(desired)
+	if !tablesAdopted {
+		err = adoptTables(desired)
+		if err != nil {
+			log.Errorf("Error taking over the tables of a previous run: %v", err)
+		}
+		tablesAdopted = true
+	}
+	observed := ObservedState(desired, reconciled)
+	actions := Plan(desired, observed, reconciled)
+
+	if len(actions) == 0 {
+		log.Infof("Reconcile (%s): no changes", reason)
+	}
+	for _, action := range actions {
+		log.Infof("Reconcile (%s): %s", reason, action)
+	}
+
+	errs := Apply(ctx, actions)
+
+	for _, d := range desired {
+		err := d.Err
+		if err == nil {
+			err = errs[d.MeshName]
+		}
+		SetMeshError(d.MeshName, err)
+		reconciled[d.MeshName] = reconciledMesh{identity: d.Identity, publicKey: d.Host.Current.PublicKey}
+	}
+	for _, action := range actions {
+		if action.Type == ActionDelete {
+			SetMeshError(action.MeshName, nil)
+			delete(reconciled, action.MeshName)
+		}
+	}
+
+	return actions, ctx.Err()
+}
+
+// RememberMeshes records the meshes of a message that was applied before this
+// process started, so meshes removed from it can still be cleaned up
+func RememberMeshes(id *Identity, msg model.Message) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	rememberMeshes(reconciled, id, msg)
+}
+
+func rememberMeshes(applied map[string]reconciledMesh, id *Identity, msg model.Message) {
+	for _, mesh := range msg.Config {
+		if _, found := applied[mesh.MeshName]; found {
+			continue
+		}
+		for _, host := range mesh.Hosts {
+			if host.HostGroup == id.HostID {
+				applied[mesh.MeshName] = reconciledMesh{identity: id, publicKey: host.Current.PublicKey}
+			}
+		}
+	}
+}
+
+// DesiredState builds the config of every mesh from the messages of every identity
+func DesiredState() ([]*DesiredMesh, error) {
+	msg, err := LoadMessages()
+	if err != nil {
+		return nil, err
+	}
+	return DesiredStateFor(msg), nil
+}
+
+// DesiredStateFor builds the config of every mesh in a message
+func DesiredStateFor(msg model.Message) []*DesiredMesh {
+	subnets, err := GetLocalSubnets(meshNames(msg))
+	if err != nil {
+		log.Errorf("GetLocalSubnets, err = %v", err)
+	}
+	lan := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		lan = append(lan, subnet.String())
+	}
+
+	// a broken overrides file leaves the meshes as they are rather than
+	// dropping the local settings
+	overrides, overridesErr := LoadOverrides()
+	if overridesErr != nil {
+		log.Error(overridesErr)
+	}
+	advertised := loadAdvertisedRoutes()
+	policies, policiesErr := LoadPolicies()
+	if policiesErr != nil {
+		log.Error(policiesErr)
+	}
+
+	desired := make([]*DesiredMesh, 0, len(msg.Config))
+	for _, mesh := range msg.Config {
+		index := -1
+		for j, host := range mesh.Hosts {
+			if IsSelf(host) {
+				index = j
+				break
+			}
+		}
+		if index == -1 {
+			log.Errorf("This host is not in mesh %s", mesh.MeshName)
+			continue
+		}
+
+		d := &DesiredMesh{
+			MeshName: mesh.MeshName,
+			Host:     mesh.Hosts[index],
+			Identity: IdentityFor(mesh.Hosts[index].HostGroup),
+			Peers:    make([]model.Host, 0, len(mesh.Hosts)-1),
+		}
+		for j, host := range mesh.Hosts {
+			if j != index {
+				d.Peers = append(d.Peers, host)
+			}
+		}
+		d.Peers = removeLocalSubnets(d.Peers, subnets)
+
+		// Check to see if we have the private key
+		key, found := KeyLookup(d.Identity, d.Host.Current.PublicKey)
+		if !found {
+			key = d.Host.Current.PrivateKey
+			d.StoreKey = key != ""
+		}
+
+		// If the private key is blank create a new one, to be sent to meshify
+		if key == "" {
+			wg, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				d.Err = err
+				desired = append(desired, d)
+				continue
+			}
+			d.OldPublicKey = d.Host.Current.PublicKey
+			d.Host.Current.PrivateKey = wg.String()
+			d.Host.Current.PublicKey = wg.PublicKey().String()
+			d.NewKey = true
+		} else {
+			d.Host.Current.PrivateKey = key
+		}
+
+		if overridesErr != nil {
+			d.Err = overridesErr
+			desired = append(desired, d)
+			continue
+		}
+		d.Local = d.Host
+		if o, found := overrides[d.MeshName]; found {
+			o.ApplyOverrides(&d.Local, d.Peers)
+			d.Overrides = o.Describe()
+		}
+
+		// an interface we can't read keeps the routes it had
+		d.AdvertisedRoutes = advertised[d.MeshName]
+		d.Routes, err = SubnetRoutes(d.MeshName)
+		if err != nil {
+			log.Errorf("Mesh %s: %v", d.MeshName, err)
+			d.Routes = d.AdvertisedRoutes
+		}
+		d.Forward = d.Routes
+		if config.OfferExitNode[d.MeshName] {
+			d.Forward = append(append([]string{}, d.Routes...), defaultRoutes...)
+		}
+
+		// a broken policy keeps the firewall that is there
+		if policiesErr == nil {
+			d.ACLs, err = ResolveACLs(d.MeshName, policies[d.MeshName], d.Local, d.Peers)
+		}
+		if policiesErr != nil || err != nil {
+			if err == nil {
+				err = policiesErr
+			}
+			d.Err = err
+			desired = append(desired, d)
+			continue
+		}
+
+		// a missing exit node leaves the mesh as it is, since the kill switch
+		// may be all that keeps traffic off the LAN
+		d.ExitNode, err = useExitNode(d.MeshName, d.Peers, lan)
+		if err != nil {
+			d.Err = err
+			desired = append(desired, d)
+			continue
+		}
+
+		config, err := DumpWireguardConfig(&d.Local, &d.Peers)
+		if err != nil {
+			d.Err = fmt.Errorf("error on template: %v", err)
+		}
+		d.Config = config
+		desired = append(desired, d)
+	}
+
+	return desired
+}
+
+// ObservedState reads the config file and interface state of the desired
+// meshes and of any mesh we applied before
+func ObservedState(desired []*DesiredMesh, applied map[string]reconciledMesh) map[string]*ObservedMesh {
+	names := make(map[string]bool)
+	for _, d := range desired {
+		names[d.MeshName] = true
+	}
+	for name := range applied {
+		names[name] = true
+	}
+
+	running := make(map[string]bool)
+	interfaces, err := CurrentDriver().Interfaces()
+	if err != nil {
+		log.Errorf("Error listing the running meshes: %v", err)
+	}
+	for _, name := range interfaces {
+		running[name] = true
+	}
+
+	observed := make(map[string]*ObservedMesh)
+	for name := range names {
+		o := &ObservedMesh{MeshName: name}
+
+		config, err := ioutil.ReadFile(GetWireguardPath() + name + ".conf")
+		if err == nil {
+			o.Config = config
+		}
+
+		o.Up = running[name]
+		observed[name] = o
+	}
+	return observed
+}
+
+// Plan lists the actions that take the observed state to the desired state.
+// Meshes that were applied but are no longer desired are deleted.
+func Plan(desired []*DesiredMesh, observed map[string]*ObservedMesh, applied map[string]reconciledMesh) []Action {
+	actions := make([]Action, 0)
+	wanted := make(map[string]bool)
+	mapped := make(map[string]bool)
+	for _, name := range PortMappedMeshes() {
+		mapped[name] = true
+	}
+
+	for _, d := range desired {
+		wanted[d.MeshName] = true
+		if d.Err != nil {
+			log.Errorf("Not changing mesh %s: %v", d.MeshName, d.Err)
+			continue
+		}
+
+		if d.NewKey {
+			actions = append(actions, Action{Type: ActionKey, MeshName: d.MeshName, Reason: "no private key, generating one", mesh: d})
+		} else if d.StoreKey {
+			actions = append(actions, Action{Type: ActionKey, MeshName: d.MeshName, Reason: "private key is not in the key store", mesh: d})
+		}
+
+		if d.Local.Current.UPnP {
+			actions = append(actions, Action{Type: ActionUPnP, MeshName: d.MeshName, Reason: "map the listen port", mesh: d})
+		} else {
+			if mapped[d.MeshName] {
+				actions = append(actions, Action{Type: ActionUnmap, MeshName: d.MeshName, Reason: "UPnP is off", mesh: d})
+			}
+			if config.Stun && d.Local.Current.ListenPort != 0 {
+				actions = append(actions, Action{Type: ActionSTUN, MeshName: d.MeshName, Reason: "discover public endpoint", mesh: d})
+			}
+		}
+
+		// the firewall goes first, so a new peer is never let in before it
+		if firewallChanged(d.MeshName, d.ACLs) {
+			reason := "remove the firewall"
+			if d.ACLs != nil {
+				reason = fmt.Sprintf("firewall with %d rules", len(d.ACLs))
+			}
+			actions = append(actions, Action{Type: ActionACL, MeshName: d.MeshName, Reason: reason, mesh: d})
+		}
+
+		o := observed[d.MeshName]
+		if o == nil {
+			o = &ObservedMesh{MeshName: d.MeshName}
+		}
+
+		if !d.Host.Enable {
+			if o.Up || (o.Config != nil && !bytes.Equal(o.Config, d.Config)) {
+				actions = append(actions, Action{Type: ActionDown, MeshName: d.MeshName, Reason: "mesh is disabled", mesh: d})
+			}
+		} else if o.Config == nil {
+			actions = append(actions, Action{Type: ActionUp, MeshName: d.MeshName, Reason: "new mesh", mesh: d})
+		} else if !bytes.Equal(o.Config, d.Config) {
+			// only changes to the interface itself need a restart, which drops every session
+			peers, live := DiffPeers(o.Config, d.Config)
+			if o.Up && live {
+				actions = append(actions, Action{Type: ActionPeers, MeshName: d.MeshName, Reason: "peers changed: " + peers.String(), mesh: d, peers: peers, previous: o.Config})
+			} else {
+				actions = append(actions, Action{Type: ActionUp, MeshName: d.MeshName, Reason: "config changed", mesh: d, previous: o.Config})
+			}
+		} else if !o.Up {
+			actions = append(actions, Action{Type: ActionStart, MeshName: d.MeshName, Reason: "interface is down", mesh: d})
+		}
+		last := len(actions) - 1
+		restarted := last >= 0 && actions[last].MeshName == d.MeshName && (actions[last].Type == ActionUp || actions[last].Type == ActionStart)
+
+		if d.Host.Enable {
+			_, changed := advertiseRoutes(d.Host.Current.AllowedIPs, d.Routes, d.AdvertisedRoutes)
+			changed = changed || (len(d.Routes) > 0 && !d.Host.Current.SubnetRouting)
+			if changed || routingChanged(d.MeshName, meshPrefixes(d.Local), d.Forward) {
+				actions = append(actions, Action{Type: ActionRoutes, MeshName: d.MeshName, Reason: routesReason(d.Routes, d.AdvertisedRoutes), mesh: d})
+			}
+
+			// the rules of an exit node go with the interface
+			if exitNodeChanged(d.MeshName, d.ExitNode) || (restarted && d.ExitNode != nil) {
+				reason := "stop using the exit node"
+				if d.ExitNode != nil {
+					reason = "send all traffic through " + config.UseExitNode[d.MeshName].Peer
+				}
+				actions = append(actions, Action{Type: ActionExit, MeshName: d.MeshName, Reason: reason, mesh: d})
+			}
+		}
+	}
+
+	// meshes we applied before that meshify no longer sends
+	names := make([]string, 0, len(applied))
+	for name := range applied {
+		if !wanted[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := applied[name]
+		actions = append(actions, Action{Type: ActionDelete, MeshName: name, Reason: "no longer configured", identity: r.identity, key: r.publicKey})
+	}
+
+	// port mappings of meshes that are gone, even from before a restart
+	for _, name := range PortMappedMeshes() {
+		if !wanted[name] {
+			actions = append(actions, Action{Type: ActionUnmap, MeshName: name, Reason: "mesh is gone"})
+		}
+	}
+
+	return actions
+}
+
+// Apply carries out the actions in order, returning the errors by mesh
+func Apply(ctx context.Context, actions []Action) map[string]error {
+	errs := make(map[string]error)
+	unprotected := make(map[string]bool)
+	for _, action := range actions {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// a mesh whose firewall failed is not brought up or given new peers,
+		// which would let in what the ACLs keep out
+		switch action.Type {
+		case ActionUp, ActionPeers, ActionStart:
+			if unprotected[action.MeshName] {
+				log.Errorf("Not applying %s, its firewall failed", action)
+				continue
+			}
+		}
+
+		err := action.apply()
+		if err != nil && action.Type == ActionACL {
+			unprotected[action.MeshName] = true
+		}
+		if err != nil {
+			log.Errorf("Error applying %s: %v", action, err)
+			if errs[action.MeshName] == nil {
+				errs[action.MeshName] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (a Action) apply() error {
+	switch a.Type {
+	case ActionUp, ActionPeers, ActionStart, ActionDown, ActionDelete:
+		// a newer change replaces one still on probation
+		EndProbation(a.MeshName)
+	}
+
+	switch a.Type {
+	case ActionKey:
+		d := a.mesh
+		if d.NewKey {
+			// delete the old public key
+			KeyDelete(d.Identity, d.OldPublicKey)
+		}
+		KeyAdd(d.Identity, d.Host.Current.PublicKey, d.Host.Current.PrivateKey)
+		err := KeySave(d.Identity)
+		if err != nil {
+			return fmt.Errorf("error saving key %s: %v", d.Host.Current.PublicKey, err)
+		}
+		if d.NewKey {
+			// Update meshify with the new public key
+			host := d.Host
+			host.Current.PrivateKey = ""
+			return UpdateMeshifyHost(host)
+		}
+		return nil
+
+	case ActionUPnP:
+		// a listen port fixed locally is the one to map, but only the
+		// endpoint goes back to meshify, not the other local overrides.  As
+		// with STUN, a mesh works without it, so errors are only logged.
+		host := a.mesh.Host
+		host.Current.PrivateKey = ""
+		ConfigureUPnP(host, a.mesh.Local.Current.ListenPort)
+		return nil
+
+	case ActionUnmap:
+		return RemoveMeshPortMappings(a.MeshName)
+
+	case ActionSTUN:
+		// this comes before the mesh is brought up, so the listen port is
+		// free again by then.  A mesh works without it, so errors are only logged.
+		host := a.mesh.Host
+		host.Current.PrivateKey = ""
+		ConfigureSTUN(host, a.mesh.Local.Current.ListenPort)
+		return nil
+
+	case ActionUp:
+		// only a mesh that was working before can be judged by its handshakes
+		working, _ := recentHandshake(a.MeshName)
+		err := StopWireguard(a.MeshName)
+		if err != nil {
+			log.Errorf("Error stopping wireguard: %v", err)
+		}
+		path := GetWireguardPath() + a.MeshName + ".conf"
+		err = util.WriteFile(path, a.mesh.Config)
+		if err != nil {
+			return fmt.Errorf("error writing file %s : %v", path, err)
+		}
+		err = StartWireguard(a.MeshName)
+		if err != nil {
+			if working && a.previous != nil {
+				rollBack(a.MeshName, a.mesh.Config, a.previous)
+			}
+			return err
+		}
+		log.Infof("Started %s", a.MeshName)
+		if working {
+			WatchApply(a.MeshName, a.mesh.Config, a.previous)
+		}
+		return nil
+
+	case ActionPeers:
+		// the sessions survive a live update, so there is nothing to watch
+		path := GetWireguardPath() + a.MeshName + ".conf"
+		err := util.WriteFile(path, a.mesh.Config)
+		if err != nil {
+			return fmt.Errorf("error writing file %s : %v", path, err)
+		}
+		err = CurrentDriver().ApplyPeers(a.MeshName, a.peers)
+		if err != nil {
+			log.Errorf("Error updating peers of %s, restarting it: %v", a.MeshName, err)
+			return Action{Type: ActionUp, MeshName: a.MeshName, Reason: a.Reason, mesh: a.mesh, previous: a.previous}.apply()
+		}
+		return nil
+
+	case ActionStart:
+		err := StartWireguard(a.MeshName)
+		if err != nil {
+			return err
+		}
+		log.Infof("Started %s", a.MeshName)
+		return nil
+
+	case ActionRoutes:
+		d := a.mesh
+		err := applySubnetRouting(a.MeshName, meshPrefixes(d.Local), d.Forward)
+		if err != nil {
+			log.Errorf("Error forwarding the subnet routes of %s: %v", a.MeshName, err)
+		}
+		allowed, changed := advertiseRoutes(d.Host.Current.AllowedIPs, d.Routes, d.AdvertisedRoutes)
+		routes := len(d.Routes) > 0
+		if changed || (routes && !d.Host.Current.SubnetRouting) {
+			// SubnetRouting is only cleared when the last of our routes is withdrawn
+			host := d.Host
+			host.Current.AllowedIPs = allowed
+			if routes || len(d.AdvertisedRoutes) > 0 {
+				host.Current.SubnetRouting = routes
+			}
+			host.Current.PrivateKey = ""
+			err := UpdateMeshifyHost(host)
+			if err != nil {
+				return err
+			}
+		}
+		saveErr := saveAdvertisedRoutes(a.MeshName, d.Routes)
+		if saveErr != nil {
+			return saveErr
+		}
+		return err
+
+	case ActionExit:
+		return applyExitNode(a.MeshName, a.mesh.ExitNode)
+
+	case ActionACL:
+		return applyFirewall(a.MeshName, a.mesh.ACLs)
+
+	case ActionDown:
+		stopSubnetRouting(a.MeshName)
+		stopExitNode(a.MeshName)
+		path := GetWireguardPath() + a.MeshName + ".conf"
+		err := util.WriteFile(path, a.mesh.Config)
+		if err != nil {
+			log.Errorf("Error writing file %s : %v", path, err)
+		}
+		log.Infof("Mesh %s is disabled.  Stopping service if running.", a.MeshName)
+		return StopWireguard(a.MeshName)
+
+	case ActionDelete:
+		log.Infof("Deleting mesh %v", a.MeshName)
+		stopSubnetRouting(a.MeshName)
+		stopExitNode(a.MeshName)
+		if err := applyFirewall(a.MeshName, nil); err != nil {
+			log.Errorf("Error removing the firewall of %s: %v", a.MeshName, err)
+		}
+		saveAdvertisedRoutes(a.MeshName, nil)
+		err := StopWireguard(a.MeshName)
+		os.Remove(GetDataPath() + a.MeshName + ".conf")
+		os.Remove(GetWireguardPath() + a.MeshName + ".conf")
+		if a.identity != nil && a.key != "" {
+			KeyDelete(a.identity, a.key)
+			KeySave(a.identity)
+		}
+		return err
+	}
+
+	return fmt.Errorf("unknown action %s", a.Type)
+}
+
+// StartNetworkWatcher reconciles whenever the addresses on the local interfaces change
+func StartNetworkWatcher(ctx context.Context) error {
+	last := networkSignature()
+	for {
+		if !sleepContext(ctx, networkWatchInterval) {
+			return nil
+		}
+		current := networkSignature()
+		if current == last {
+			continue
+		}
+		last = current
+
+		log.Infof("Local network changed, reconciling")
+		_, err := Reconcile(ctx, "network change")
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("Error reconciling after network change: %v", err)
+		}
+	}
+}
+
+// networkSignature summarizes the local addresses so changes can be detected
+func networkSignature() string {
+	msg, _ := LoadMessages()
+	subnets, err := GetLocalSubnets(meshNames(msg))
+	if err != nil {
+		return ""
+	}
+	addrs := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		addrs = append(addrs, subnet.String())
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
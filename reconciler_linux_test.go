@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/meshify-app/meshify/model"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeHost sets up the reconciler to run against a FakeDriver, with its
+// files in a temporary directory, as host group hg1
+func fakeHost(t *testing.T) *FakeDriver {
+	t.Helper()
+
+	savedConfig, savedWireguard, savedData := config, wireguardPath, dataPath
+	t.Cleanup(func() {
+		config, wireguardPath, dataPath = savedConfig, savedWireguard, savedData
+		SetDriver(nil)
+	})
+
+	config.HostID = "hg1"
+	wireguardPath = t.TempDir() + "/"
+	dataPath = t.TempDir() + "/"
+
+	KeyInitialize()
+	f := NewFakeDriver()
+	SetDriver(f)
+	return f
+}
+
+func testKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testHost(hostGroup string, address string, endpoint string, key wgtypes.Key) model.Host {
+	host := model.Host{Name: hostGroup, HostGroup: hostGroup, MeshName: "mesh1", Enable: true}
+	host.Current.PublicKey = key.PublicKey().String()
+	host.Current.Address = []string{address + "/24"}
+	host.Current.AllowedIPs = []string{address + "/32"}
+	host.Current.ListenPort = 51820
+	host.Current.Endpoint = endpoint
+	return host
+}
+
+// reconcile runs one pass of the reconciler over msg, as Reconcile does for
+// the messages on disk
+func reconcile(t *testing.T, applied map[string]reconciledMesh, msg model.Message) []ActionType {
+	t.Helper()
+
+	desired := DesiredStateFor(msg)
+	actions := Plan(desired, ObservedState(desired, applied), applied)
+	errs := Apply(context.Background(), actions)
+	for mesh, err := range errs {
+		t.Errorf("mesh %s: %v", mesh, err)
+	}
+
+	for _, d := range desired {
+		if d.Err != nil {
+			t.Errorf("mesh %s: %v", d.MeshName, d.Err)
+		}
+		applied[d.MeshName] = reconciledMesh{identity: d.Identity, publicKey: d.Host.Current.PublicKey}
+	}
+	types := make([]ActionType, 0, len(actions))
+	for _, action := range actions {
+		if action.Type == ActionDelete {
+			delete(applied, action.MeshName)
+		}
+		types = append(types, action.Type)
+	}
+	return types
+}
+
+func TestReconcileFakeDriver(t *testing.T) {
+	f := fakeHost(t)
+	applied := make(map[string]reconciledMesh)
+
+	key := testKey(t)
+	self := testHost("hg1", "10.99.0.1", "203.0.113.1:51820", key)
+	self.Current.PrivateKey = key.String()
+	peer1 := testHost("hg2", "10.99.0.2", "203.0.113.2:51820", testKey(t))
+	peer1.Current.AllowedIPs = append(peer1.Current.AllowedIPs, "192.168.77.0/24")
+	peer2 := testHost("hg3", "10.99.0.3", "203.0.113.3:51820", testKey(t))
+
+	msg := model.Message{Config: []model.HostConfig{{MeshName: "mesh1", Hosts: []model.Host{self, peer1, peer2}}}}
+
+	// a new mesh stores its key and comes up with every peer
+	types := reconcile(t, applied, msg)
+	if want := []ActionType{ActionKey, ActionUp}; !reflect.DeepEqual(types, want) {
+		t.Errorf("new mesh: actions %v, want %v", types, want)
+	}
+	if names, _ := f.Interfaces(); !reflect.DeepEqual(names, []string{"mesh1"}) {
+		t.Errorf("interfaces %v, want [mesh1]", names)
+	}
+	peers := []string{peer1.Current.PublicKey, peer2.Current.PublicKey}
+	sort.Strings(peers)
+	if got := f.Peers("mesh1"); !reflect.DeepEqual(got, peers) {
+		t.Errorf("peers %v, want %v", got, peers)
+	}
+	allowed := f.AllowedIPs("mesh1", peer1.Current.PublicKey)
+	sort.Strings(allowed)
+	if want := []string{"10.99.0.2/32", "192.168.77.0/24"}; !reflect.DeepEqual(allowed, want) {
+		t.Errorf("allowed IPs of peer1 %v, want %v", allowed, want)
+	}
+	if private, found := KeyLookup(IdentityFor("hg1"), self.Current.PublicKey); !found || private != self.Current.PrivateKey {
+		t.Errorf("private key was not stored")
+	}
+
+	// the same message again changes nothing
+	if types := reconcile(t, applied, msg); len(types) != 0 {
+		t.Errorf("same config: actions %v, want none", types)
+	}
+
+	// a peer that leaves is removed without a restart
+	msg.Config[0].Hosts = []model.Host{self, peer1}
+	types = reconcile(t, applied, msg)
+	if want := []ActionType{ActionPeers}; !reflect.DeepEqual(types, want) {
+		t.Errorf("peer removed: actions %v, want %v", types, want)
+	}
+	if got := f.Peers("mesh1"); !reflect.DeepEqual(got, []string{peer1.Current.PublicKey}) {
+		t.Errorf("peers %v, want [%s]", got, peer1.Current.PublicKey)
+	}
+
+	// a mesh meshify no longer sends is taken down and its key forgotten
+	types = reconcile(t, applied, model.Message{})
+	if want := []ActionType{ActionDelete}; !reflect.DeepEqual(types, want) {
+		t.Errorf("mesh removed: actions %v, want %v", types, want)
+	}
+	if names, _ := f.Interfaces(); len(names) != 0 {
+		t.Errorf("interfaces %v, want none", names)
+	}
+	if _, found := KeyLookup(IdentityFor("hg1"), self.Current.PublicKey); found {
+		t.Errorf("private key was not deleted")
+	}
+
+	// up stops whatever was running first
+	want := []string{"down mesh1", "up mesh1", "peers mesh1", "down mesh1"}
+	if calls := f.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("driver calls %v, want %v", calls, want)
+	}
+}
+
+// meshify-client plan runs in its own process, so it asks the agent what it
+// has applied before planning
+func TestPlanConverged(t *testing.T) {
+	fakeHost(t)
+	applied := make(map[string]reconciledMesh)
+
+	// nft only has to succeed
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(bin+"/nft", []byte("#!/bin/sh\ncat > /dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	if err := ioutil.WriteFile(PolicyPath(), []byte(`{"mesh1": [{"peers": ["hg2"], "protocol": "tcp", "ports": ["22"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { useAppliedState(AppliedState{}) })
+
+	key := testKey(t)
+	self := testHost("hg1", "10.99.0.1", "203.0.113.1:51820", key)
+	self.Current.PrivateKey = key.String()
+	peer := testHost("hg2", "10.99.0.2", "203.0.113.2:51820", testKey(t))
+	msg := model.Message{Config: []model.HostConfig{{MeshName: "mesh1", Hosts: []model.Host{self, peer}}}}
+
+	types := reconcile(t, applied, msg)
+	if want := []ActionType{ActionKey, ActionACL, ActionUp}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("new mesh: actions %v, want %v", types, want)
+	}
+
+	agent := httptest.NewServer(localOnly(appliedHandler))
+	defer agent.Close()
+
+	state, reached, err := fetchAppliedState(agent.URL)
+	if !reached || err != nil {
+		t.Fatalf("fetchAppliedState: reached %v, %v", reached, err)
+	}
+
+	// a new process has applied nothing until it asks
+	useAppliedState(AppliedState{})
+	desired := DesiredStateFor(msg)
+	if actions := Plan(desired, ObservedState(desired, applied), applied); len(actions) != 1 || actions[0].Type != ActionACL {
+		t.Errorf("without the agent: actions %v, want [%s]", actions, ActionACL)
+	}
+
+	useAppliedState(state)
+	desired = DesiredStateFor(msg)
+	if actions := Plan(desired, ObservedState(desired, applied), applied); len(actions) != 0 {
+		t.Errorf("converged mesh: actions %v, want none", actions)
+	}
+}
+
+// the tables of a previous run are taken over, or deleted with their mesh
+func TestAdoptTables(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+if [ "$1" = list ]; then
+	printf 'table inet filter\ntable inet meshify-acl-mesh1\ntable inet meshify-route-gone\ntable inet meshify-killswitch-mesh1\n'
+else
+	cat >> ` + dir + `/scripts
+fi
+`
+	if err := ioutil.WriteFile(dir+"/nft", []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	saved := CurrentAppliedState()
+	t.Cleanup(func() { useAppliedState(saved) })
+	useAppliedState(AppliedState{})
+
+	err := adoptTables([]*DesiredMesh{{MeshName: "mesh1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scripts, _ := ioutil.ReadFile(dir + "/scripts")
+	if want := "delete table inet meshify-route-gone\n"; string(scripts) != want {
+		t.Errorf("nft scripts %q, want %q", scripts, want)
+	}
+	want := AppliedState{
+		Firewalls: map[string]string{"mesh1": unknownSignature},
+		Routing:   map[string]string{},
+		ExitNodes: map[string]string{"mesh1": unknownSignature},
+	}
+	if got := CurrentAppliedState(); !reflect.DeepEqual(got, want) {
+		t.Errorf("applied state %+v, want %+v", got, want)
+	}
+}
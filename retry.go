@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const (
+	retryMaxDelay    = 5 * time.Minute
+	breakerThreshold = 5
+
+	// a probe that records nothing in this long is given up on, so a caller
+	// that forgets to record can't hold the breaker half-open for good
+	probeTimeout = 2 * time.Minute
+)
+
+// apiError is returned when meshify answers with anything other than success
+type apiError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (err *apiError) Error() string {
+	if err.StatusCode == http.StatusUnauthorized {
+		return "Unauthorized"
+	}
+	return fmt.Sprintf("response error code: %v", err.StatusCode)
+}
+
+// backoffError is returned instead of making a call while a policy is backing off
+type backoffError struct {
+	policy string
+	wait   time.Duration
+}
+
+func (err *backoffError) Error() string {
+	return fmt.Sprintf("%s backing off, next attempt in %v", err.policy, err.wait.Round(time.Second))
+}
+
+// IsBackoff returns true if the call was skipped because of an earlier failure
+func IsBackoff(err error) bool {
+	_, ok := err.(*backoffError)
+	return ok
+}
+
+// NewAPIError builds an apiError from a response, honoring Retry-After
+func NewAPIError(resp *http.Response) error {
+	err := &apiError{StatusCode: resp.StatusCode}
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		if secs, e := strconv.Atoi(after); e == nil {
+			err.RetryAfter = time.Duration(secs) * time.Second
+		} else if t, e := http.ParseTime(after); e == nil {
+			err.RetryAfter = time.Until(t)
+		}
+	}
+	return err
+}
+
+// IsUnauthorized returns true if the error is a 401 from meshify
+func IsUnauthorized(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.StatusCode == http.StatusUnauthorized
+}
+
+// IsOutage returns true if the error means the controller itself is unhealthy,
+// as opposed to the server rejecting this particular request
+func IsOutage(err error) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		// transport errors, timeouts, etc.
+		return true
+	}
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// RetryStatus is the view of a RetryPolicy served by the local API
+type RetryStatus struct {
+	Name      string
+	State     string
+	Failures  int
+	NextRetry time.Time
+	LastError string
+	Active    bool
+}
+
+// RetryPolicy implements exponential backoff with jitter and a circuit breaker
+type RetryPolicy struct {
+	lock      sync.Mutex
+	name      string
+	breaker   bool
+	state     string
+	failures  int
+	next      time.Time
+	probing   time.Time
+	lastError string
+
+	// OnFailure is called after each failure is recorded
+	OnFailure func(p *RetryPolicy)
+}
+
+// controlPlane is used for calls made before the controller list is loaded.
+// Each controller has its own policy, and only outages count against it.
+var controlPlane = NewRetryPolicy("meshify", true)
+
+// Client errors (401, 403, ...) back off per caller without opening the breaker
+var hostPolicy = NewRetryPolicy("host", false)
+var servicePolicy = NewRetryPolicy("service", false)
+
+func NewRetryPolicy(name string, breaker bool) *RetryPolicy {
+	return &RetryPolicy{name: name, breaker: breaker, state: BreakerClosed}
+}
+
+// Backoff returns how long until the next call is allowed, zero if it is
+// allowed now.  Unlike Check it changes nothing, so it can be used to look.
+func (p *RetryPolicy) Backoff() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.backoff()
+}
+
+func (p *RetryPolicy) backoff() time.Duration {
+	if p.state != BreakerClosed && time.Since(p.probing) < probeTimeout {
+		// only the probe goes through until it is recorded
+		return time.Second
+	}
+	wait := time.Until(p.next)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// Check returns a backoffError if a call should not be made right now.  When
+// the breaker is open the call it allows is the probe, so every call that
+// passes Check must end in Success, Failure or Record.
+func (p *RetryPolicy) Check() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if wait := p.backoff(); wait > 0 {
+		return &backoffError{policy: p.name, wait: wait}
+	}
+	if p.state != BreakerClosed {
+		// let a single probe through
+		p.state = BreakerHalfOpen
+		p.probing = time.Now()
+		log.Infof("Circuit breaker for %s is %s, probing", p.name, p.state)
+	}
+	return nil
+}
+
+// Success resets the policy after a call succeeds
+func (p *RetryPolicy) Success() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.state != BreakerClosed {
+		log.Infof("Circuit breaker for %s is %s after %d failures", p.name, BreakerClosed, p.failures)
+	}
+	p.state = BreakerClosed
+	p.failures = 0
+	p.probing = time.Time{}
+	p.next = time.Time{}
+	p.lastError = ""
+}
+
+// Failure records a failed call and schedules the next attempt
+func (p *RetryPolicy) Failure(err error) {
+	p.failure(err)
+	if p.OnFailure != nil {
+		p.OnFailure(p)
+	}
+}
+
+func (p *RetryPolicy) failure(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.failures++
+	p.probing = time.Time{}
+	p.lastError = err.Error()
+
+	// exponential backoff from CheckInterval, with jitter so agents don't retry in lockstep
+	base := time.Duration(config.CheckInterval) * time.Second
+	if base <= 0 {
+		base = 10 * time.Second
+	}
+	delay := retryMaxDelay
+	if p.failures < 16 {
+		delay = base << uint(p.failures-1)
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	if e, ok := err.(*apiError); ok && e.RetryAfter > delay {
+		delay = e.RetryAfter
+	}
+	p.next = time.Now().Add(delay)
+
+	if p.breaker && p.failures >= breakerThreshold && p.state != BreakerOpen {
+		p.state = BreakerOpen
+		log.Errorf("Circuit breaker for %s is %s after %d failures: %s", p.name, p.state, p.failures, p.lastError)
+	}
+	log.Infof("%s failure %d (%s), next attempt in %v", p.name, p.failures, p.lastError, delay.Round(time.Second))
+}
+
+// Record calls Success or Failure depending on err.  Errors that are not outages
+// are recorded against local, and only outages against the shared control plane.
+func (p *RetryPolicy) Record(local *RetryPolicy, err error) {
+	if err == nil {
+		p.Success()
+		if local != nil {
+			local.Success()
+		}
+		return
+	}
+	if IsOutage(err) {
+		p.Failure(err)
+		return
+	}
+	// the controller answered, so it is up
+	p.Success()
+	if local != nil {
+		local.Failure(err)
+	}
+}
+
+// Status returns a snapshot of the policy
+func (p *RetryPolicy) Status() RetryStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return RetryStatus{
+		Name:      p.name,
+		State:     p.state,
+		Failures:  p.failures,
+		NextRetry: p.next,
+		LastError: p.lastError,
+	}
+}
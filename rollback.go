@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	util "github.com/meshify-app/meshify/util"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// How often to look for a handshake while a new config is on probation, and
+// how recent a handshake has to be to show the tunnel works
+const (
+	rollbackCheckInterval = 5 * time.Second
+	handshakeFresh        = 3 * time.Minute
+)
+
+// rejectedConfigs are the configs that were rolled back, by mesh.  They are
+// not applied again until meshify sends something different.  probation
+// is the watch on a mesh whose new config hasn't been confirmed yet.
+var (
+	rejectedConfigs = make(map[string][]byte)
+	probation       = make(map[string]*probationWatch)
+	rollbackLock    sync.Mutex
+)
+
+// probationWatch is one watch of a mesh.  A watch that was replaced by a
+// newer one ends without touching it.
+type probationWatch struct {
+	cancel context.CancelFunc
+}
+
+// RejectedConfig returns an error if config is one that was rolled back on
+// the mesh.  Any other config clears the rejection.
+func RejectedConfig(meshName string, data []byte) error {
+	rollbackLock.Lock()
+	defer rollbackLock.Unlock()
+
+	rejected, found := rejectedConfigs[meshName]
+	if !found {
+		return nil
+	}
+	if bytes.Equal(rejected, data) {
+		return errRolledBack()
+	}
+	delete(rejectedConfigs, meshName)
+	return nil
+}
+
+// markRejected stops the reconciler from applying a config that was rolled back
+func markRejected(desired []*DesiredMesh) {
+	for _, d := range desired {
+		if d.Err != nil {
+			continue
+		}
+		if err := RejectedConfig(d.MeshName, d.Config); err != nil {
+			d.Err = err
+		}
+	}
+}
+
+// WatchApply puts a config that was just applied to a working mesh on
+// probation.  If no peer completes a handshake within config.RollbackWindow
+// seconds the previous config is restored, since a mesh that is down may be
+// the only way to reach this host.
+func WatchApply(meshName string, applied []byte, previous []byte) {
+	if config.RollbackWindow <= 0 || previous == nil {
+		return
+	}
+
+	// peers without an endpoint wait for us, so without one there is nobody to
+	// handshake with on our own
+	peers, err := parseWireguardConfig(applied)
+	if err != nil {
+		return
+	}
+	endpoints := false
+	for _, peer := range peers.Peers {
+		if peer.get("endpoint") != "" {
+			endpoints = true
+		}
+	}
+	if !endpoints {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := &probationWatch{cancel: cancel}
+	rollbackLock.Lock()
+	if w, found := probation[meshName]; found {
+		w.cancel()
+	}
+	probation[meshName] = watch
+	rollbackLock.Unlock()
+
+	go func() {
+		defer endWatch(meshName, watch)
+
+		deadline := time.Now().Add(time.Duration(config.RollbackWindow) * time.Second)
+		probePeers(peers)
+		for {
+			ok, known := recentHandshake(meshName)
+			if ok || !known {
+				if !known {
+					log.Infof("Can't read the handshakes of %s, keeping the new config", meshName)
+				} else {
+					log.Infof("New config for %s is working", meshName)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+			if !sleepContext(ctx, rollbackCheckInterval) {
+				return
+			}
+		}
+
+		RollBack(meshName, applied, previous)
+	}()
+}
+
+// EndProbation stops watching a mesh, because it was changed again or removed
+func EndProbation(meshName string) {
+	rollbackLock.Lock()
+	defer rollbackLock.Unlock()
+
+	if w, found := probation[meshName]; found {
+		w.cancel()
+		delete(probation, meshName)
+	}
+}
+
+// endWatch ends a watch, leaving the probation of the mesh alone if a newer
+// watch has replaced it
+func endWatch(meshName string, watch *probationWatch) {
+	rollbackLock.Lock()
+	defer rollbackLock.Unlock()
+
+	watch.cancel()
+	if probation[meshName] == watch {
+		delete(probation, meshName)
+	}
+}
+
+// RollBack restores the previous config of a mesh, unless the config has
+// changed again since
+func RollBack(meshName string, applied []byte, previous []byte) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	rollBack(meshName, applied, previous)
+}
+
+// rollBack is RollBack for callers that hold reconcileLock
+func rollBack(meshName string, applied []byte, previous []byte) {
+	path := GetWireguardPath() + meshName + ".conf"
+	current, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(current, applied) {
+		return
+	}
+
+	err = errRolledBack()
+	log.Errorf("Mesh %s: %v", meshName, err)
+
+	rollbackLock.Lock()
+	rejectedConfigs[meshName] = applied
+	rollbackLock.Unlock()
+	SetMeshError(meshName, err)
+
+	err = StopWireguard(meshName)
+	if err != nil {
+		log.Errorf("Error stopping wireguard: %v", err)
+	}
+	err = util.WriteFile(path, previous)
+	if err != nil {
+		log.Errorf("Error writing file %s : %v", path, err)
+		return
+	}
+	err = StartWireguard(meshName)
+	if err != nil {
+		log.Errorf("Error restoring the previous config of %s: %v", meshName, err)
+		return
+	}
+	log.Infof("Restored the previous config of %s", meshName)
+}
+
+func errRolledBack() error {
+	return fmt.Errorf("config was rolled back after no peer completed a handshake within %ds", config.RollbackWindow)
+}
+
+// recentHandshake reports whether any peer of the mesh has a recent handshake.
+// known is false if wireguard can't be asked.
+func recentHandshake(meshName string) (ok bool, known bool) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return false, false
+	}
+	defer wg.Close()
+
+	device, err := wg.Device(meshName)
+	if err != nil {
+		return false, false
+	}
+	for _, peer := range device.Peers {
+		if !peer.LastHandshakeTime.IsZero() && time.Since(peer.LastHandshakeTime) < handshakeFresh {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// probePeers sends a packet into the tunnel for each peer, since wireguard
+// only starts a handshake when there is something to send
+func probePeers(peers *wgQuickConfig) {
+	for _, peer := range peers.Peers {
+		if peer.get("endpoint") == "" {
+			continue
+		}
+		for _, cidr := range peer.allowedIPs() {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			// the discard port, nothing needs to answer
+			conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "9"))
+			if err != nil {
+				continue
+			}
+			conn.Write([]byte{0})
+			conn.Close()
+			break
+		}
+	}
+}
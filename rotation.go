@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var meshifyHostApiKeyAPIFmt = "%s/api/v1.0/host/%s/apikey"
+
+// Ahead of a key expiring meshify announces its replacement in these headers.
+// Both keys are accepted until the old one expires.
+const (
+	nextApiKeyHeader        = "X-Meshify-Next-Api-Key"
+	nextApiKeyExpiresHeader = "X-Meshify-Api-Key-Expires"
+)
+
+// RotateApiKey handles a key announced by meshify.  The new key is saved before
+// it is used, and only becomes the current key once meshify has accepted it.
+func (id *Identity) RotateApiKey(ctl *Controller, header http.Header) {
+	next := header.Get(nextApiKeyHeader)
+	if next == "" || next == id.ApiKey {
+		return
+	}
+
+	if next != id.NextApiKey {
+		log.Infof("Meshify announced a new API key for %s, current key expires %s", id, header.Get(nextApiKeyExpiresHeader))
+		id.SetApiKeys(id.ApiKey, next, id.PreviousApiKey)
+		err := saveConfig()
+		if err != nil {
+			log.Errorf("Error saving the new API key for %s, not switching: %v", id, err)
+			return
+		}
+	}
+
+	err := ConfirmApiKey(ctl, id.HostID, next)
+	if err != nil {
+		// we still have the old key, try again on the next call
+		log.Errorf("Error confirming the new API key for %s: %v", id, err)
+		return
+	}
+
+	id.SetApiKeys(next, "", id.ApiKey)
+	err = saveConfig()
+	if err != nil {
+		log.Errorf("Error saving config after API key rotation: %v", err)
+	}
+	log.Infof("Switched %s to its new API key", id)
+}
+
+// ConfirmApiKey tells meshify we have switched, authenticating with the new key
+func ConfirmApiKey(ctl *Controller, hostID string, key string) error {
+	client, err := HTTPClient()
+	if err != nil {
+		return err
+	}
+
+	var reqURL string = fmt.Sprintf(meshifyHostApiKeyAPIFmt, ctl.URL, hostID)
+	log.Infof("  POST %s", reqURL)
+
+	req, err := http.NewRequest("POST", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", key)
+	req.Header.Set("User-Agent", userAgent())
+
+	if err := ctl.Policy.Check(); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		ctl.Policy.Record(nil, err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		err = NewAPIError(resp)
+	}
+	ctl.Policy.Record(nil, err)
+	return err
+}
+
+// RecoverApiKey is called when meshify refuses the current key.  It tries the
+// announced and previous keys, which cover a rotation interrupted on either
+// side, and keeps whichever is accepted.  The meshes are left running either way.
+func (id *Identity) RecoverApiKey(etag *string) ([]byte, error) {
+	current := id.ApiKey
+	for _, key := range []string{id.NextApiKey, id.PreviousApiKey} {
+		if key == "" || key == current {
+			continue
+		}
+
+		id.SetApiKey(key)
+		// the backoff was for the other key
+		id.Policy().Success()
+		body, err := CallMeshify(id, etag)
+		if err == nil {
+			log.Infof("Recovered %s with another API key", id)
+			id.SetApiKeys(key, "", "")
+			err = saveConfig()
+			if err != nil {
+				log.Errorf("Error saving config: %v", err)
+			}
+			return body, nil
+		}
+		id.SetApiKey(current)
+	}
+
+	return nil, fmt.Errorf("no API key for %s was accepted", id)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// routing is what SetSubnetRouting was last called with for each mesh, so it
+// is only redone when something changes
+var (
+	routing     = make(map[string]string)
+	routingLock sync.Mutex
+)
+
+// AdvertisedRoutesPath is the file of the routes reported to meshify, by
+// mesh, so they can be withdrawn when they are no longer configured
+func AdvertisedRoutesPath() string {
+	return GetDataPath() + "routes.json"
+}
+
+// SubnetRoutes resolves config.SubnetRoutes for a mesh.  Entries are CIDRs or
+// the names of interfaces, which stand for the networks they are on.
+func SubnetRoutes(meshName string) ([]string, error) {
+	entries := config.SubnetRoutes[meshName]
+	routes := make([]string, 0, len(entries))
+	seen := make(map[string]bool)
+	add := func(p netip.Prefix) {
+		cidr := p.Masked().String()
+		if !seen[cidr] {
+			seen[cidr] = true
+			routes = append(routes, cidr)
+		}
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if p, err := netip.ParsePrefix(entry); err == nil {
+			add(p)
+			continue
+		}
+		iface, err := net.InterfaceByName(entry)
+		if err != nil {
+			return nil, fmt.Errorf("subnet route %s is neither a CIDR nor an interface", entry)
+		}
+		subnets, err := interfaceSubnets(*iface)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range subnets {
+			add(p)
+		}
+	}
+	sort.Strings(routes)
+	return routes, nil
+}
+
+// loadAdvertisedRoutes reads the routes last reported to meshify
+func loadAdvertisedRoutes() map[string][]string {
+	advertised := make(map[string][]string)
+	data, err := ioutil.ReadFile(AdvertisedRoutesPath())
+	if err == nil {
+		err = json.Unmarshal(data, &advertised)
+		if err != nil {
+			log.Errorf("Error reading %s: %v", AdvertisedRoutesPath(), err)
+		}
+	}
+	return advertised
+}
+
+func saveAdvertisedRoutes(meshName string, routes []string) error {
+	advertised := loadAdvertisedRoutes()
+	if len(routes) == 0 {
+		if _, found := advertised[meshName]; !found {
+			return nil
+		}
+		delete(advertised, meshName)
+	} else {
+		advertised[meshName] = routes
+	}
+	data, err := json.Marshal(advertised)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(AdvertisedRoutesPath(), data, 0600)
+}
+
+// advertiseRoutes works out the AllowedIPs this host should have in meshify:
+// its own with the routes added, less routes advertised before and since
+// dropped.  changed is false if meshify already has them.
+func advertiseRoutes(allowed []string, routes []string, previous []string) ([]string, bool) {
+	wanted := make(map[string]bool)
+	for _, cidr := range routes {
+		wanted[cidr] = true
+	}
+	withdrawn := make(map[string]bool)
+	for _, cidr := range previous {
+		if !wanted[cidr] {
+			withdrawn[cidr] = true
+		}
+	}
+
+	result := make([]string, 0, len(allowed)+len(routes))
+	changed := false
+	present := make(map[string]bool)
+	for _, cidr := range allowed {
+		if withdrawn[strings.TrimSpace(cidr)] {
+			changed = true
+			continue
+		}
+		present[strings.TrimSpace(cidr)] = true
+		result = append(result, cidr)
+	}
+	for _, cidr := range routes {
+		if !present[cidr] {
+			result = append(result, cidr)
+			changed = true
+		}
+	}
+	return result, changed
+}
+
+// meshPrefixes are the networks of the addresses of this host on a mesh,
+// which traffic to the subnet routes comes from
+func meshPrefixes(host model.Host) []string {
+	prefixes := make([]string, 0, len(host.Current.Address))
+	for _, address := range host.Current.Address {
+		if p, err := netip.ParsePrefix(strings.TrimSpace(address)); err == nil {
+			prefixes = append(prefixes, p.Masked().String())
+		}
+	}
+	return prefixes
+}
+
+func routingSignature(sources []string, routes []string) string {
+	if len(routes) == 0 {
+		return ""
+	}
+	return strings.Join(sources, ",") + " " + strings.Join(routes, ",")
+}
+
+// routingChanged is true if SetSubnetRouting needs calling for a mesh
+func routingChanged(meshName string, sources []string, routes []string) bool {
+	routingLock.Lock()
+	defer routingLock.Unlock()
+
+	return routing[meshName] != routingSignature(sources, routes)
+}
+
+// applySubnetRouting forwards traffic from a mesh to its subnet routes, or
+// stops forwarding when there are none
+func applySubnetRouting(meshName string, sources []string, routes []string) error {
+	err := SetSubnetRouting(meshName, sources, routes)
+	if err != nil {
+		return err
+	}
+
+	routingLock.Lock()
+	defer routingLock.Unlock()
+	if len(routes) == 0 {
+		delete(routing, meshName)
+	} else {
+		routing[meshName] = routingSignature(sources, routes)
+	}
+	return nil
+}
+
+// stopSubnetRouting is called for a mesh that is going down or away
+func stopSubnetRouting(meshName string) {
+	err := applySubnetRouting(meshName, nil, nil)
+	if err != nil {
+		log.Errorf("Error removing the subnet routing of %s: %v", meshName, err)
+	}
+}
+
+// routesReason describes the routes that are added and withdrawn
+func routesReason(routes []string, previous []string) string {
+	wanted := make(map[string]bool)
+	for _, cidr := range routes {
+		wanted[cidr] = true
+	}
+	had := make(map[string]bool)
+	for _, cidr := range previous {
+		had[cidr] = true
+	}
+	parts := make([]string, 0)
+	for _, cidr := range routes {
+		if !had[cidr] {
+			parts = append(parts, "advertise "+cidr)
+		}
+	}
+	for _, cidr := range previous {
+		if !wanted[cidr] {
+			parts = append(parts, "withdraw "+cidr)
+		}
+	}
+	if len(parts) == 0 {
+		return "forward subnet routes"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// routingTable is the nftables table of the subnet routing of a mesh
+func routingTable(meshName string) string {
+	return "meshify-route-" + meshName
+}
+
+// SetSubnetRouting forwards traffic from the mesh addresses to the subnet
+// routes, which include 0.0.0.0/0 and ::/0 for an exit node.  Traffic that
+// leaves the mesh is masqueraded, so hosts on those subnets need no route
+// back to it.  The rules are an nftables table per mesh, replaced in one
+// transaction as SetFirewall does.  Another firewall that drops forwarded
+// traffic, such as a FORWARD policy of DROP, has to let it through itself.
+// No routes removes the table.  IP forwarding is turned on and left on,
+// since other things on the host may rely on it.
+func SetSubnetRouting(meshName string, sources []string, routes []string) error {
+	table := routingTable(meshName)
+	if len(sources) == 0 || len(routes) == 0 {
+		if _, err := exec.LookPath("nft"); err != nil {
+			return nil
+		}
+		return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", table, table))
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&script, "table inet %s {\n\tchain postrouting {\n", table)
+	fmt.Fprintf(&script, "\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, family := range []string{"ip", "ip6"} {
+		v6 := family == "ip6"
+		src := coveringPrefixes(familyPrefixes(sources, v6))
+		dst := coveringPrefixes(familyPrefixes(routes, v6))
+		if len(src) == 0 || len(dst) == 0 {
+			continue
+		}
+		err := enableForwarding(v6)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&script, "\t\toifname != \"%s\" %s saddr { %s } %s daddr { %s } masquerade\n",
+			meshName, family, strings.Join(src, ", "), family, strings.Join(dst, ", "))
+	}
+	fmt.Fprintf(&script, "\t}\n}\n")
+
+	return nft(script.String())
+}
+
+// familyPrefixes picks the IPv4 or IPv6 CIDRs from a list
+func familyPrefixes(cidrs []string, v6 bool) []string {
+	result := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if p, err := netip.ParsePrefix(cidr); err == nil && p.Addr().Is6() == v6 {
+			result = append(result, cidr)
+		}
+	}
+	return result
+}
+
+// coveringPrefixes drops the prefixes that are inside another in the list,
+// since nftables won't take a set whose intervals overlap
+func coveringPrefixes(cidrs []string) []string {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefixes = append(prefixes, netip.MustParsePrefix(cidr).Masked())
+	}
+
+	result := make([]string, 0, len(prefixes))
+	for i, p := range prefixes {
+		covered := false
+		for j, q := range prefixes {
+			if i != j && q.Bits() <= p.Bits() && q.Contains(p.Addr()) && (q != p || j < i) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, p.String())
+		}
+	}
+	return result
+}
+
+func enableForwarding(v6 bool) error {
+	path := "/proc/sys/net/ipv4/ip_forward"
+	if v6 {
+		path = "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+	err := ioutil.WriteFile(path, []byte("1"), 0644)
+	if err != nil {
+		return fmt.Errorf("error enabling IP forwarding: %v", err)
+	}
+	return nil
+}
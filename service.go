@@ -8,6 +8,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -34,7 +35,7 @@ func (m *Meshify) Execute(args []string, r <-chan svc.ChangeRequest, changes cha
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 
 	elog.Info(1, "Meshify Service Started")
-	DoWork()
+	agent := StartAgent(context.Background())
 
 loop:
 
@@ -67,6 +68,7 @@ loop:
 		}
 	}
 	changes <- svc.Status{State: svc.StopPending}
+	StopAgent(agent)
 	return
 }
 
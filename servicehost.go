@@ -2,13 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/meshify-app/meshify/model"
@@ -18,10 +17,8 @@ import (
 var meshifyServiceHostAPIFmt = "%s/api/v1.0/service/%s/status"
 var meshifyServiceHostUpdateAPIFmt = "%s/api/v1.0/service/%s"
 
-// StartHTTPClient starts the client polling
-func StartServiceHost(c chan []byte) {
-	host := config.MeshifyHost
-	var client *http.Client
+// StartServiceHost starts the client polling
+func StartServiceHost(ctx context.Context, c chan []byte) error {
 	var etag string
 
 	err := StartContainers()
@@ -29,29 +26,13 @@ func StartServiceHost(c chan []byte) {
 		log.Errorf("Error starting containers %v", err)
 	}
 
-	if strings.HasPrefix(host, "http:") {
-		client = &http.Client{
-			Timeout: time.Second * 10,
-		}
-	} else {
-		// Create a transport like http.DefaultTransport, but with the configured LocalAddr
-		transport := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 60 * time.Second,
-				LocalAddr: config.sourceAddr,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
-		client = &http.Client{
-			Transport: transport,
-		}
-
-	}
-
 	for {
-		content := <-c
+		var content []byte
+		select {
+		case <-ctx.Done():
+			return nil
+		case content = <-c:
+		}
 		if !config.loaded {
 			err := loadConfig()
 			if err != nil {
@@ -61,40 +42,68 @@ func StartServiceHost(c chan []byte) {
 
 		// Only make API call if ServiceGroup is set
 		if config.ServiceGroup != "" && config.ServiceApiKey != "" {
+			ctl := ActiveController()
+			host := ctl.URL
+
+			client, err := HTTPClient()
+			if err != nil {
+				log.Errorf("Error creating http client: %v", err)
+				continue
+			}
+
 			var reqURL string = fmt.Sprintf(meshifyServiceHostAPIFmt, host, config.ServiceGroup)
 			if !config.Quiet {
 				log.Infof("  GET %s", reqURL)
 			}
 
-			req, err := http.NewRequest("GET", reqURL, bytes.NewBuffer(content))
+			req, err := http.NewRequestWithContext(ctx, "GET", reqURL, bytes.NewBuffer(content))
 			if err != nil {
-				return
+				return err
 			}
 			if req != nil {
 				req.Header.Set("X-API-KEY", config.ServiceApiKey)
-				req.Header.Set("User-Agent", "meshify-client/1.0")
+				req.Header.Set("User-Agent", userAgent())
 				req.Header.Set("Content-Type", "application/json")
 				req.Header.Set("If-None-Match", etag)
 			}
+
+			// don't call the server while we are backing off from earlier
+			// failures.  The service policy never probes, so it goes first.
+			if err := servicePolicy.Check(); err != nil {
+				log.Debugf("Not getting service config: %v", err)
+				continue
+			}
+			if err := ctl.Policy.Check(); err != nil {
+				log.Debugf("Not getting service config: %v", err)
+				continue
+			}
 			resp, err := client.Do(req)
 			if err == nil {
 
 				if resp.StatusCode == 304 {
+					ctl.Policy.Record(servicePolicy, nil)
 				} else if resp.StatusCode != 200 {
-					log.Errorf("Response Error Code: %v, sleeping 10 seconds", resp.StatusCode)
-					time.Sleep(10 * time.Second)
+					log.Errorf("Response Error Code: %v", resp.StatusCode)
+					ctl.Policy.Record(servicePolicy, NewAPIError(resp))
 				} else {
+					ctl.Policy.Record(servicePolicy, nil)
 					body, err := ioutil.ReadAll(resp.Body)
 					if err != nil {
 						log.Errorf("error reading body %v", err)
 					}
 					log.Debugf("%s", string(body))
-					etag = resp.Header.Get("ETag")
-					UpdateServiceHostConfig(body)
+					err = VerifyMessage(nil, body, resp.Header.Get(signatureHeader))
+					if err != nil {
+						RejectMessage(ctl, meshifyServiceRejectAPIFmt, config.ServiceGroup, config.ServiceApiKey, resp.Header.Get("ETag"), err)
+						servicePolicy.Failure(err)
+					} else {
+						etag = resp.Header.Get("ETag")
+						UpdateServiceHostConfig(body)
+					}
 				}
 			} else {
-				log.Errorf("ERROR: %v, sleeping 10 seconds", err)
-				time.Sleep(10 * time.Second)
+				log.Errorf("ERROR: %v", err)
+				ctl.Policy.Record(servicePolicy, err)
 			}
 			if resp != nil {
 				resp.Body.Close()
@@ -159,28 +168,12 @@ func StartContainers() error {
 func UpdateMeshifyServiceHost(service model.Service) error {
 
 	log.Infof("UPDATING SERVICE: %v", service)
-	server := config.MeshifyHost
-	var client *http.Client
-
-	if strings.HasPrefix(server, "http:") {
-		client = &http.Client{
-			Timeout: time.Second * 10,
-		}
-	} else {
-		// Create a transport like http.DefaultTransport, but with the configured LocalAddr
-		transport := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 60 * time.Second,
-				LocalAddr: config.sourceAddr,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
-		client = &http.Client{
-			Transport: transport,
-		}
+	ctl := ActiveController()
+	server := ctl.URL
 
+	client, err := HTTPClient()
+	if err != nil {
+		return err
 	}
 
 	var reqURL string = fmt.Sprintf(meshifyServiceHostUpdateAPIFmt, server, service.Id)
@@ -196,14 +189,19 @@ func UpdateMeshifyServiceHost(service model.Service) error {
 	}
 	if req != nil {
 		req.Header.Set("X-API-KEY", config.ServiceApiKey)
-		req.Header.Set("User-Agent", "meshify-client/1.0")
+		req.Header.Set("User-Agent", userAgent())
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	if err := ctl.Policy.Check(); err != nil {
+		log.Errorf("Not updating service %s: %v", service.Id, err)
+		return err
+	}
 	resp, err := client.Do(req)
 	if err == nil {
 		if resp.StatusCode != 200 {
 			log.Errorf("PATCH Error: Response %v", resp.StatusCode)
+			err = NewAPIError(resp)
 		} else {
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
@@ -212,6 +210,7 @@ func UpdateMeshifyServiceHost(service model.Service) error {
 			log.Infof("%s", string(body))
 		}
 	}
+	ctl.Policy.Record(nil, err)
 
 	if resp != nil {
 		resp.Body.Close()
@@ -220,7 +219,7 @@ func UpdateMeshifyServiceHost(service model.Service) error {
 		req.Body.Close()
 	}
 
-	return nil
+	return err
 }
 
 // UpdateServiceHostConfig updates the config from the server
@@ -367,47 +366,43 @@ func StopService(service model.Service) {
 	}
 }
 
-// DoServiceWork catches any errors in the service and recovers from them, if possible
-func DoServiceWork() {
-	var curTs int64
-
-	// recover from any panics coming from below
-	defer func() {
-		if r := recover(); r != nil {
-			var ok bool
-			err, ok := r.(error)
-			if !ok {
-				log.Fatalf("Fatal Error: %v", err)
-			}
-		}
-	}()
-
-	go func() {
+// DoServiceWork starts the service host subsystems under the supervisor
+func DoServiceWork(s *Supervisor) {
 
-		// Determine current timestamp (the wallclock time we'll retrieve files using)
-
-		c := make(chan []byte)
-		go StartServiceHost(c)
+	c := make(chan []byte)
+	s.Go("service host", func(ctx context.Context) error { return StartServiceHost(ctx, c) })
+	s.Go("service poll", func(ctx context.Context) error { return pollServiceHost(ctx, c) })
+}
 
-		curTs = calculateCurrentTimestamp()
+// pollServiceHost pokes the service host channel every CheckInterval
+func pollServiceHost(ctx context.Context, c chan []byte) error {
+	var curTs int64
 
-		t := time.Unix(curTs, 0)
-		log.Infof("current timestamp = %v (%s)", curTs, t.UTC())
+	// Determine current timestamp (the wallclock time we'll retrieve files using)
+	curTs = calculateCurrentTimestamp()
 
-		for {
-			time.Sleep(100 * time.Millisecond)
-			ts := time.Now()
+	t := time.Unix(curTs, 0)
+	log.Infof("current timestamp = %v (%s)", curTs, t.UTC())
 
-			if ts.Unix() >= curTs {
+	for {
+		if !sleepContext(ctx, 100*time.Millisecond) {
+			return nil
+		}
+		ts := time.Now()
 
-				// call the channel to trigger the next poll
-				b := []byte("Service")
-				c <- b
+		if ts.Unix() >= curTs {
 
-				curTs = calculateCurrentTimestamp()
-				curTs += config.CheckInterval
+			// call the channel to trigger the next poll
+			b := []byte("Service")
+			select {
+			case <-ctx.Done():
+				return nil
+			case c <- b:
 			}
 
+			curTs = calculateCurrentTimestamp()
+			curTs += config.CheckInterval
 		}
-	}()
+
+	}
 }
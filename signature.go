@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var meshifyHostRejectAPIFmt = "%s/api/v1.0/host/%s/rejected"
+var meshifyServiceRejectAPIFmt = "%s/api/v1.0/service/%s/rejected"
+
+// meshify signs every config body with ed25519 and sends the signature in this header
+const signatureHeader = "X-Meshify-Signature"
+
+var (
+	errUnsigned     = errors.New("message is not signed")
+	errBadSignature = errors.New("message signature does not match")
+)
+
+// Rejection records a config message we refused to apply
+type Rejection struct {
+	Etag   string    `json:"etag"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+var (
+	LastRejection  *Rejection
+	RejectionCount int
+	RejectionLock  sync.Mutex
+)
+
+// VerifyMessage checks the detached signature of a message from meshify
+// against the ControllerKey pinned for the identity.  With no key pinned,
+// every message is accepted.
+func VerifyMessage(id *Identity, body []byte, signature string) error {
+	pinned := id.PinnedControllerKey()
+	if pinned == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(pinned)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid ControllerKey in config")
+	}
+
+	if signature == "" {
+		return errUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), body, sig) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// RejectMessage logs a message that failed verification and reports it to meshify
+func RejectMessage(ctl *Controller, apiFmt string, id string, apiKey string, etag string, reason error) {
+	rejection := Rejection{Etag: etag, Reason: reason.Error(), Time: time.Now()}
+
+	RejectionLock.Lock()
+	LastRejection = &rejection
+	RejectionCount++
+	RejectionLock.Unlock()
+
+	log.Errorf("REJECTED config from %s (etag %s): %v", ctl.URL, etag, reason)
+
+	go ReportRejection(ctl, apiFmt, id, apiKey, rejection)
+}
+
+// ReportRejection tells meshify we refused a config.  If the channel is being
+// tampered with this may not arrive, but a legitimate server will see it.
+func ReportRejection(ctl *Controller, apiFmt string, id string, apiKey string, rejection Rejection) error {
+
+	client, err := HTTPClient()
+	if err != nil {
+		return err
+	}
+
+	var reqURL string = fmt.Sprintf(apiFmt, ctl.URL, id)
+	log.Infof("  POST %s", reqURL)
+	content, err := json.Marshal(rejection)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", apiKey)
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := ctl.Policy.Check(); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		ctl.Policy.Record(nil, err)
+		log.Errorf("Error reporting rejection: %v", err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		log.Errorf("Error reporting rejection: Response %v", resp.StatusCode)
+		err = NewAPIError(resp)
+	}
+	ctl.Policy.Record(nil, err)
+	return err
+}
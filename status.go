@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+var meshifyHostHeartbeatAPIFmt = "%s/api/v1.0/host/%s/heartbeat"
+
+// Version of the agent, set at build time with -ldflags "-X main.Version=..."
+var Version = "1.0.0"
+
+// userAgent is sent with every request to meshify
+func userAgent() string {
+	return "meshify-client/" + Version
+}
+
+// PeerStatus is what wireguard reports for one peer of a mesh
+type PeerStatus struct {
+	PublicKey     string    `json:"publicKey"`
+	Name          string    `json:"name"`
+	Endpoint      string    `json:"endpoint"`
+	LastHandshake time.Time `json:"lastHandshake"`
+	ReceiveBytes  int64     `json:"receiveBytes"`
+	TransmitBytes int64     `json:"transmitBytes"`
+}
+
+// HostStatus is the periodic report for one host (one mesh) of this agent
+type HostStatus struct {
+	HostID        string       `json:"hostId"`
+	MeshName      string       `json:"meshName"`
+	Version       string       `json:"version"`
+	Platform      string       `json:"platform"`
+	InterfaceUp   bool         `json:"interfaceUp"`
+	Peers         []PeerStatus `json:"peers"`
+	ReceiveBytes  int64        `json:"receiveBytes"`
+	TransmitBytes int64        `json:"transmitBytes"`
+	LastError     string       `json:"lastError,omitempty"`
+	Overrides     []string     `json:"overrides,omitempty"`
+	Rejection     *Rejection   `json:"rejection,omitempty"`
+	Time          time.Time    `json:"time"`
+
+	apiKey string
+}
+
+// meshErrors holds the last error applying each mesh, cleared when it applies cleanly
+var (
+	meshErrors   = make(map[string]string)
+	meshErrorsMu sync.Mutex
+)
+
+// SetMeshError records the result of the last attempt to configure a mesh
+func SetMeshError(mesh string, err error) {
+	meshErrorsMu.Lock()
+	defer meshErrorsMu.Unlock()
+
+	if err == nil {
+		delete(meshErrors, mesh)
+	} else {
+		meshErrors[mesh] = err.Error()
+	}
+}
+
+// MeshError returns the last error configuring a mesh, if any
+func MeshError(mesh string) string {
+	meshErrorsMu.Lock()
+	defer meshErrorsMu.Unlock()
+
+	return meshErrors[mesh]
+}
+
+// BuildStatus reports on every mesh of every identity
+func BuildStatus() ([]HostStatus, error) {
+	msg, err := LoadMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	// wgctrl may not be able to reach the devices, in which case we report no peers
+	wg, err := wgctrl.New()
+	if err != nil {
+		log.Errorf("Error opening wireguard control: %v", err)
+	} else {
+		defer wg.Close()
+	}
+
+	RejectionLock.Lock()
+	rejection := LastRejection
+	RejectionLock.Unlock()
+
+	overrides, err := LoadOverrides()
+	if err != nil {
+		log.Error(err)
+	}
+
+	status := make([]HostStatus, 0, len(msg.Config))
+	for _, mesh := range msg.Config {
+		names := make(map[string]string)
+		var self *HostStatus
+		for _, host := range mesh.Hosts {
+			names[host.Current.PublicKey] = host.Name
+			if IsSelf(host) && self == nil {
+				self = &HostStatus{
+					HostID:   host.Id,
+					MeshName: mesh.MeshName,
+					apiKey:   host.APIKey,
+				}
+			}
+		}
+		if self == nil {
+			continue
+		}
+
+		self.Version = Version
+		self.Platform = Platform()
+		self.LastError = MeshError(mesh.MeshName)
+		if o, found := overrides[mesh.MeshName]; found {
+			self.Overrides = o.Describe()
+		}
+		self.Rejection = rejection
+		self.Time = time.Now()
+		self.Peers = make([]PeerStatus, 0)
+
+		if iface, err := net.InterfaceByName(mesh.MeshName); err == nil {
+			self.InterfaceUp = iface.Flags&net.FlagUp != 0
+		}
+
+		if wg != nil {
+			device, err := wg.Device(mesh.MeshName)
+			if err == nil {
+				for _, peer := range device.Peers {
+					p := PeerStatus{
+						PublicKey:     peer.PublicKey.String(),
+						Name:          names[peer.PublicKey.String()],
+						LastHandshake: peer.LastHandshakeTime,
+						ReceiveBytes:  peer.ReceiveBytes,
+						TransmitBytes: peer.TransmitBytes,
+					}
+					if peer.Endpoint != nil {
+						p.Endpoint = peer.Endpoint.String()
+					}
+					self.Peers = append(self.Peers, p)
+					self.ReceiveBytes += peer.ReceiveBytes
+					self.TransmitBytes += peer.TransmitBytes
+				}
+			}
+		}
+
+		status = append(status, *self)
+	}
+
+	return status, nil
+}
+
+// StartHeartbeat sends the status of each host to meshify every HeartbeatInterval seconds
+func StartHeartbeat(ctx context.Context) error {
+	if config.HeartbeatInterval <= 0 {
+		log.Infof("Heartbeat disabled")
+		return nil
+	}
+
+	for {
+		if !sleepContext(ctx, time.Duration(config.HeartbeatInterval)*time.Second) {
+			return nil
+		}
+
+		status, err := BuildStatus()
+		if err != nil {
+			log.Debugf("No status to report: %v", err)
+			continue
+		}
+
+		for _, s := range status {
+			err = SendHeartbeat(s)
+			if err != nil && !IsBackoff(err) {
+				log.Errorf("Error sending heartbeat for %s: %v", s.MeshName, err)
+			}
+		}
+	}
+}
+
+// SendHeartbeat posts the status of one host to the controller of the identity it belongs to
+func SendHeartbeat(status HostStatus) error {
+	ctl := ActiveController()
+	if id := MeshOwner(status.MeshName); id != nil {
+		ctl = id.Controllers().Active()
+	}
+
+	client, err := HTTPClient()
+	if err != nil {
+		return err
+	}
+
+	var reqURL string = fmt.Sprintf(meshifyHostHeartbeatAPIFmt, ctl.URL, status.HostID)
+	if !config.Quiet {
+		log.Infof("  POST %s", reqURL)
+	}
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", status.apiKey)
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := ctl.Policy.Check(); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		ctl.Policy.Record(nil, err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		err = NewAPIError(resp)
+	}
+	ctl.Policy.Record(nil, err)
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var meshifyHostEventsAPIFmt = "%s/api/v1.0/host/%s/events"
+
+// While the stream is up we still poll occasionally in case an event was lost
+const streamRefreshInterval = 300
+
+// If the server sends nothing at all (not even a keepalive) for this long, reconnect
+const streamIdleTimeout = 120 * time.Second
+
+var errStreamUnsupported = errors.New("server does not support event streaming")
+
+// streamActive counts the identities with a server-sent events connection open to meshify
+var streamActive int32
+
+// streamBodies are the open streams, so they can be closed when we switch controllers
+var (
+	streamBodies = make(map[*Identity]io.Closer)
+	streamLock   sync.Mutex
+)
+
+// StreamActive returns true if config changes are being pushed by the server for every identity
+func StreamActive() bool {
+	active := atomic.LoadInt32(&streamActive)
+	return active > 0 && int(active) >= len(Identities())
+}
+
+// StartStream holds a server-sent events connection open to meshify and pokes
+// the channel whenever the server announces a change.  If the server does not
+// support streaming the agent keeps polling every CheckInterval, and tries
+// again only after switching to a different controller.
+func StartStream(ctx context.Context, id *Identity, c chan []byte) error {
+
+	for {
+		ctl := id.Controllers().Active()
+		err := StreamMeshify(ctx, id, ctl, c)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == errStreamUnsupported {
+			log.Infof("Event stream not supported by %s, polling every %d seconds", ctl.URL, config.CheckInterval)
+			for id.Controllers().Active() == ctl {
+				if !sleepContext(ctx, time.Duration(config.CheckInterval)*time.Second) {
+					return nil
+				}
+			}
+			continue
+		}
+		if err != nil && !IsBackoff(err) {
+			log.Errorf("Event stream error: %v", err)
+		}
+
+		wait := time.Duration(config.CheckInterval) * time.Second
+		if backoff := id.Controllers().Active().Policy.Backoff(); backoff > wait {
+			wait = backoff
+		}
+		if !sleepContext(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+// RestartStream closes the event streams of the identities that use a set of
+// controllers, so they reconnect to its active controller
+func RestartStream(cs *ControllerSet) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	for id, body := range streamBodies {
+		if id.Controllers() == cs {
+			body.Close()
+		}
+	}
+}
+
+// StreamMeshify opens the event stream and blocks until it is closed or ctx is done
+func StreamMeshify(ctx context.Context, id *Identity, ctl *Controller, c chan []byte) error {
+
+	host := ctl.URL
+
+	// No client timeout here, the connection is expected to stay open
+	client, err := StreamClient()
+	if err != nil {
+		return err
+	}
+
+	var reqURL string = fmt.Sprintf(meshifyHostEventsAPIFmt, host, id.HostID)
+	log.Infof("  STREAM %s", reqURL)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", id.ApiKey)
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	if err := ctl.Policy.Check(); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		ctl.Policy.Record(nil, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// a controller without streams still answered, so it is up
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ctl.Policy.Record(nil, nil)
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotAcceptable, http.StatusNotImplemented:
+		ctl.Policy.Record(nil, nil)
+		return errStreamUnsupported
+	default:
+		err = NewAPIError(resp)
+		ctl.Policy.Record(nil, err)
+		return err
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return errStreamUnsupported
+	}
+
+	atomic.AddInt32(&streamActive, 1)
+	log.Infof("Event stream for %s connected to %s", id, host)
+
+	streamLock.Lock()
+	streamBodies[id] = resp.Body
+	streamLock.Unlock()
+	defer func() {
+		streamLock.Lock()
+		delete(streamBodies, id)
+		streamLock.Unlock()
+		atomic.AddInt32(&streamActive, -1)
+	}()
+
+	// Changes may have happened while we were disconnected
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c <- []byte(id.String()):
+	}
+
+	// close the body if the server goes quiet, which unblocks the scanner below
+	idle := time.AfterFunc(streamIdleTimeout, func() {
+		log.Errorf("Event stream idle for %v, reconnecting", streamIdleTimeout)
+		resp.Body.Close()
+	})
+	defer idle.Stop()
+
+	event := ""
+	data := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(streamIdleTimeout)
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// a blank line dispatches the event
+			if data && event != "ping" {
+				log.Infof("Event stream for %s: %s", id, event)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case c <- []byte(id.String()):
+				}
+			}
+			event = ""
+			data = false
+		case strings.HasPrefix(line, ":"):
+			// comment, used by servers as a keepalive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream closed by server")
+}
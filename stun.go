@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// STUN message types and attributes, RFC 5389
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunMappedAddress   = 0x0001
+	stunXorMappedAddr   = 0x0020
+	stunHeaderSize      = 20
+)
+
+// How long to wait for a STUN server, and how many times to ask
+const (
+	stunTimeout  = 500 * time.Millisecond
+	stunAttempts = 3
+)
+
+// NAT types, by how the mapping of our address depends on where we send to
+const (
+	NATNone                = "none"                 // the address is not translated
+	NATEndpointIndependent = "endpoint-independent" // one mapping for every destination
+	NATEndpointDependent   = "endpoint-dependent"   // a mapping per destination, so peers can't use it
+	NATUnknown             = "unknown"              // only one server answered
+)
+
+// StunResult is what the STUN servers saw of this host
+type StunResult struct {
+	Local  *net.UDPAddr
+	Mapped *net.UDPAddr
+	NAT    string
+
+	// FromListenPort is false if the listen port was in use and could not be
+	// asked from, which is only on platforms other than Linux, so another
+	// port was asked about instead.  PortPreserved is true if the NAT kept
+	// that port, which suggests it keeps the listen port too.
+	FromListenPort bool
+	PortPreserved  bool
+}
+
+// DiscoverEndpoint asks the STUN servers for our public address from the
+// listen port of a mesh.  While the mesh is up wireguard has the port, and
+// it is asked from with a raw socket where the platform allows.
+func DiscoverEndpoint(listenPort int, servers []string) (*StunResult, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no STUN servers configured")
+	}
+
+	result := &StunResult{FromListenPort: true}
+	var binding func(server string) (*net.UDPAddr, error)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: listenPort})
+	if err == nil {
+		defer conn.Close()
+		result.Local = conn.LocalAddr().(*net.UDPAddr)
+		binding = func(server string) (*net.UDPAddr, error) { return StunBinding(conn, server) }
+	} else if raw, rawErr := newRawStun(listenPort); rawErr == nil {
+		defer raw.Close()
+		result.Local = &net.UDPAddr{IP: net.IPv4zero, Port: listenPort}
+		binding = raw.Binding
+	} else {
+		log.Infof("STUN from port %d: %v, asking from another port", listenPort, rawErr)
+		result.FromListenPort = false
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		result.Local = conn.LocalAddr().(*net.UDPAddr)
+		binding = func(server string) (*net.UDPAddr, error) { return StunBinding(conn, server) }
+	}
+
+	mapped := make([]*net.UDPAddr, 0, len(servers))
+	var lastErr error
+	for _, server := range servers {
+		addr, err := binding(server)
+		if err != nil {
+			log.Infof("STUN server %s: %v", server, err)
+			lastErr = err
+			continue
+		}
+		mapped = append(mapped, addr)
+	}
+	if len(mapped) == 0 {
+		return nil, fmt.Errorf("no STUN server answered: %v", lastErr)
+	}
+
+	result.Mapped = mapped[0]
+	result.PortPreserved = result.Mapped.Port == result.Local.Port
+	result.NAT = NATUnknown
+	if len(mapped) > 1 {
+		result.NAT = NATEndpointIndependent
+		for _, addr := range mapped[1:] {
+			if !addr.IP.Equal(result.Mapped.IP) || addr.Port != result.Mapped.Port {
+				result.NAT = NATEndpointDependent
+			}
+		}
+	}
+	if result.PortPreserved && localAddress(result.Mapped.IP) {
+		result.NAT = NATNone
+	}
+	return result, nil
+}
+
+// localAddress is true if the address is on one of our interfaces
+func localAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// StunBinding sends a binding request to a STUN server and returns the
+// address it saw the request come from
+func StunBinding(conn *net.UDPConn, server string) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := newStunRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < stunAttempts; attempt++ {
+		_, err = conn.WriteToUDP(request, raddr)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(stunTimeout << attempt))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+				continue
+			}
+			addr, err := parseStunResponse(buf[:n], request[8:20])
+			if err != nil {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			return addr, nil
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return nil, fmt.Errorf("no answer from %s", server)
+}
+
+// newStunRequest is a binding request with a new transaction ID
+func newStunRequest() ([]byte, error) {
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	_, err := rand.Read(request[8:20])
+	return request, err
+}
+
+// parseStunResponse reads the mapped address from a binding response
+func parseStunResponse(msg []byte, txid []byte) (*net.UDPAddr, error) {
+	if len(msg) < stunHeaderSize || binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie || !bytes.Equal(msg[8:20], txid) {
+		return nil, errors.New("not a binding response")
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if stunHeaderSize+length > len(msg) {
+		return nil, errors.New("short STUN message")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := msg[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		t := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+l]
+		switch t {
+		case stunXorMappedAddr:
+			if addr := decodeStunAddress(value, msg[4:20]); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = decodeStunAddress(value, nil)
+		}
+		// attributes are padded to four bytes
+		attrs = attrs[4+(l+3)&^3:]
+	}
+	if mapped == nil {
+		return nil, errors.New("no mapped address in STUN response")
+	}
+	return mapped, nil
+}
+
+// decodeStunAddress reads a MAPPED-ADDRESS, or an XOR-MAPPED-ADDRESS when
+// given the cookie and transaction ID it is masked with
+func decodeStunAddress(value []byte, mask []byte) *net.UDPAddr {
+	if len(value) < 8 {
+		return nil
+	}
+	size := net.IPv4len
+	if value[1] == 0x02 {
+		size = net.IPv6len
+	}
+	if len(value) < 4+size {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if mask != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= mask[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// encodeStunResponse answers a binding request with the address it came from
+func encodeStunResponse(request []byte, from *net.UDPAddr) []byte {
+	ip := from.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = from.IP.To16()
+		family = 0x02
+	}
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:], uint16(from.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ request[4+i]
+	}
+
+	msg := make([]byte, stunHeaderSize+4+len(value))
+	binary.BigEndian.PutUint16(msg[0:], stunBindingResponse)
+	binary.BigEndian.PutUint16(msg[2:], uint16(4+len(value)))
+	copy(msg[4:20], request[4:20])
+	binary.BigEndian.PutUint16(msg[20:], stunXorMappedAddr)
+	binary.BigEndian.PutUint16(msg[22:], uint16(len(value)))
+	copy(msg[24:], value)
+	return msg
+}
+
+// ServeSTUN answers STUN binding requests on conn until it is closed, so the
+// agent can be tested against a STUN server of its own
+func ServeSTUN(conn *net.UDPConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if n < stunHeaderSize || binary.BigEndian.Uint16(buf[0:]) != stunBindingRequest ||
+			binary.BigEndian.Uint32(buf[4:]) != stunMagicCookie {
+			continue
+		}
+		conn.WriteToUDP(encodeStunResponse(buf[:n], from), from)
+	}
+}
+
+// ConfigureSTUN finds the public address of a host with STUN and updates its
+// endpoint at meshify when it has changed, as ConfigureUPnP does, which has
+// the same arguments
+func ConfigureSTUN(host model.Host, listenPort int) error {
+	if listenPort == 0 {
+		return nil
+	}
+
+	result, err := DiscoverEndpoint(listenPort, config.StunServers)
+	if err != nil {
+		log.Errorf("STUN for %s: %v", host.MeshName, err)
+		return err
+	}
+	log.Infof("STUN for %s: public address %s, NAT %s", host.MeshName, result.Mapped, result.NAT)
+
+	if result.NAT == NATEndpointDependent {
+		log.Errorf("STUN for %s: the NAT maps each destination to a different port, so peers can't reach %s", host.MeshName, result.Mapped)
+		return nil
+	}
+
+	// the port wireguard is reached on, if it's not the one we asked from.
+	// That is a guess from whether the NAT kept the port we asked from, and
+	// failing that the port of the endpoint meshify has.
+	port := result.Mapped.Port
+	if !result.FromListenPort {
+		port = listenPort
+		if !result.PortPreserved {
+			if _, p, err := net.SplitHostPort(host.Current.Endpoint); err == nil {
+				port, _ = strconv.Atoi(p)
+			}
+		}
+	}
+	endpoint := net.JoinHostPort(result.Mapped.IP.String(), strconv.Itoa(port))
+
+	// an endpoint by name that already resolves to us is left alone
+	if current, err := net.ResolveUDPAddr("udp4", host.Current.Endpoint); err == nil {
+		if current.IP.Equal(result.Mapped.IP) && current.Port == port {
+			return nil
+		}
+	}
+	if isBogon(result.Mapped.IP.String()) {
+		return nil
+	}
+
+	log.Infof("STUN for %s: updating endpoint from %s to %s", host.MeshName, host.Current.Endpoint, endpoint)
+	host.Current.Endpoint = endpoint
+	return UpdateMeshifyHost(host)
+}
+
+// StunCommand prints what the STUN servers see of this host.  With a port it
+// asks from that port, and with -serve it answers STUN requests on it.
+//
+//	meshify-client stun [port]
+//	meshify-client stun -serve <port>
+func StunCommand(args []string) error {
+	if len(args) == 2 && args[0] == "-serve" {
+		port, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("usage: meshify-client stun -serve <port>")
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Answering STUN requests on %s\n", conn.LocalAddr())
+		return ServeSTUN(conn)
+	}
+
+	port := 0
+	if len(args) > 0 {
+		p, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("usage: meshify-client stun [port]")
+		}
+		port = p
+	}
+	result, err := DiscoverEndpoint(port, config.StunServers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Local address:  %s\n", result.Local)
+	fmt.Printf("Public address: %s\n", result.Mapped)
+	fmt.Printf("NAT:            %s\n", result.NAT)
+	if !result.FromListenPort {
+		fmt.Printf("Port %d was in use, asked from port %d instead\n", port, result.Local.Port)
+	}
+	return nil
+}
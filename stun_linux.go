@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawStun asks STUN servers from a port wireguard already has.  It writes
+// the UDP header itself on a raw socket, and the kernel hands the raw socket
+// a copy of the answer as well as giving it to wireguard, which drops it.
+type rawStun struct {
+	fd   int
+	port int
+}
+
+func newRawStun(port int) (*rawStun, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	return &rawStun{fd: fd, port: port}, nil
+}
+
+func (r *rawStun) Close() error {
+	return unix.Close(r.fd)
+}
+
+// Binding sends a binding request from the port and returns the address the
+// server saw it come from
+func (r *rawStun) Binding(server string) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	request, err := newStunRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	// no checksum, which UDP over IPv4 allows
+	packet := make([]byte, 8+len(request))
+	binary.BigEndian.PutUint16(packet[0:], uint16(r.port))
+	binary.BigEndian.PutUint16(packet[2:], uint16(raddr.Port))
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)))
+	copy(packet[8:], request)
+	to := &unix.SockaddrInet4{}
+	copy(to.Addr[:], raddr.IP.To4())
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < stunAttempts; attempt++ {
+		err = unix.Sendto(r.fd, packet, 0, to)
+		if err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(stunTimeout << attempt)
+		for {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				break
+			}
+			tv := unix.NsecToTimeval(wait.Nanoseconds())
+			unix.SetsockoptTimeval(r.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+			n, _, err := unix.Recvfrom(r.fd, buf, 0)
+			if err != nil {
+				if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+					continue
+				}
+				return nil, err
+			}
+
+			// the IP header comes first on a raw socket
+			if n < 20 {
+				continue
+			}
+			ihl := int(buf[0]&0x0f) * 4
+			if n < ihl+8 || !net.IP(buf[12:16]).Equal(raddr.IP) ||
+				binary.BigEndian.Uint16(buf[ihl:]) != uint16(raddr.Port) ||
+				binary.BigEndian.Uint16(buf[ihl+2:]) != uint16(r.port) {
+				continue
+			}
+			addr, err := parseStunResponse(buf[ihl+8:n], request[8:20])
+			if err == nil {
+				return addr, nil
+			}
+		}
+	}
+	return nil, errors.New("no answer from " + server)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// rawStun is only on Linux.  Elsewhere a port wireguard has can't be asked
+// about, so DiscoverEndpoint asks from another.
+type rawStun struct{}
+
+func newRawStun(port int) (*rawStun, error) {
+	return nil, errors.New("STUN from a port in use is not supported on " + Platform())
+}
+
+func (r *rawStun) Close() error {
+	return nil
+}
+
+func (r *rawStun) Binding(server string) (*net.UDPAddr, error) {
+	return nil, errors.New("STUN from a port in use is not supported on " + Platform())
+}
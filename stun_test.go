@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+)
+
+// serveSTUN starts a STUN server on loopback and returns its address
+func serveSTUN(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go ServeSTUN(conn)
+	return conn.LocalAddr().String()
+}
+
+func TestStunBinding(t *testing.T) {
+	server := serveSTUN(t)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	addr, err := StunBinding(conn, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if !addr.IP.Equal(local.IP) || addr.Port != local.Port {
+		t.Errorf("StunBinding = %s, want %s", addr, local)
+	}
+}
+
+func TestDiscoverEndpoint(t *testing.T) {
+	servers := []string{serveSTUN(t), serveSTUN(t)}
+
+	result, err := DiscoverEndpoint(0, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.FromListenPort || !result.PortPreserved {
+		t.Errorf("FromListenPort = %v, PortPreserved = %v, want both", result.FromListenPort, result.PortPreserved)
+	}
+	if result.NAT != NATNone {
+		t.Errorf("NAT = %s, want %s", result.NAT, NATNone)
+	}
+}
+
+// The listen port is held, as wireguard holds it while a mesh is up
+func TestDiscoverEndpointPortInUse(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("asking from a port in use needs a raw socket")
+	}
+	server := serveSTUN(t)
+
+	held, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	port := held.LocalAddr().(*net.UDPAddr).Port
+
+	result, err := DiscoverEndpoint(port, []string{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.FromListenPort {
+		t.Skipf("raw sockets are not supported on %s", Platform())
+	}
+	if result.Mapped.Port != port {
+		t.Errorf("mapped port = %d, want %d", result.Mapped.Port, port)
+	}
+}
+
+func TestParseStunResponse(t *testing.T) {
+	request, err := newStunRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		from *net.UDPAddr
+	}{
+		{"IPv4", &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51820}},
+		{"IPv6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1:2"), Port: 443}},
+		{"IPv4 port 0", &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := encodeStunResponse(request, tt.from)
+			// the address is masked, so it doesn't appear as is
+			value := response[stunHeaderSize+4:]
+			if net.IP(value[4:]).Equal(tt.from.IP) {
+				t.Errorf("address is not XOR masked")
+			}
+
+			addr, err := parseStunResponse(response, request[8:20])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !addr.IP.Equal(tt.from.IP) || addr.Port != tt.from.Port {
+				t.Errorf("parseStunResponse = %s, want %s", addr, tt.from)
+			}
+		})
+	}
+}
+
+func TestParseStunResponseMappedAddress(t *testing.T) {
+	request, err := newStunRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an RFC 3489 server answers with a plain MAPPED-ADDRESS
+	msg := make([]byte, stunHeaderSize+12)
+	binary.BigEndian.PutUint16(msg[0:], stunBindingResponse)
+	binary.BigEndian.PutUint16(msg[2:], 12)
+	copy(msg[4:20], request[4:20])
+	binary.BigEndian.PutUint16(msg[20:], stunMappedAddress)
+	binary.BigEndian.PutUint16(msg[22:], 8)
+	msg[25] = 0x01
+	binary.BigEndian.PutUint16(msg[26:], 3478)
+	copy(msg[28:], net.ParseIP("192.0.2.10").To4())
+
+	addr, err := parseStunResponse(msg, request[8:20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.0.2.10:3478" {
+		t.Errorf("parseStunResponse = %s, want 192.0.2.10:3478", addr)
+	}
+}
+
+func TestParseStunResponseRejects(t *testing.T) {
+	request, err := newStunRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := encodeStunResponse(request, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51820})
+
+	other, err := newStunRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := append([]byte(nil), response...)
+	binary.BigEndian.PutUint16(short[2:], 64)
+
+	tests := []struct {
+		name string
+		msg  []byte
+		txid []byte
+	}{
+		{"other transaction", response, other[8:20]},
+		{"request", request, request[8:20]},
+		{"truncated header", response[:10], request[8:20]},
+		{"length past the end", short, request[8:20]},
+		{"no attributes", response[:stunHeaderSize], request[8:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if addr, err := parseStunResponse(tt.msg, tt.txid); err == nil {
+				t.Errorf("parseStunResponse = %s, want an error", addr)
+			}
+		})
+	}
+}
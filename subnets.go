@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/meshify-app/meshify/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// SubtractPrefix returns the parts of p that are not in q, as the fewest
+// prefixes that cover them.  Prefixes of different families don't overlap.
+func SubtractPrefix(p netip.Prefix, q netip.Prefix) []netip.Prefix {
+	p = p.Masked()
+	q = q.Masked()
+	if !p.Overlaps(q) {
+		return []netip.Prefix{p}
+	}
+	if q.Bits() <= p.Bits() {
+		// q covers all of p
+		return []netip.Prefix{}
+	}
+
+	// walk down from p towards q, keeping the half that doesn't hold q each time
+	result := make([]netip.Prefix, 0, q.Bits()-p.Bits())
+	for bits := p.Bits(); bits < q.Bits(); bits++ {
+		half := netip.PrefixFrom(q.Addr(), bits+1).Masked()
+		result = append(result, netip.PrefixFrom(flipBit(half.Addr(), bits), bits+1))
+	}
+	return result
+}
+
+// SubtractPrefixes returns the parts of p that are in none of the subtracted prefixes
+func SubtractPrefixes(p netip.Prefix, subtract []netip.Prefix) []netip.Prefix {
+	result := []netip.Prefix{p.Masked()}
+	for _, q := range subtract {
+		next := make([]netip.Prefix, 0, len(result))
+		for _, r := range result {
+			next = append(next, SubtractPrefix(r, q)...)
+		}
+		result = next
+	}
+	return result
+}
+
+// flipBit inverts bit n of an address, counting from the most significant
+func flipBit(addr netip.Addr, n int) netip.Addr {
+	if addr.Is4() {
+		a := addr.As4()
+		a[n/8] ^= 0x80 >> (n % 8)
+		return netip.AddrFrom4(a)
+	}
+	a := addr.As16()
+	a[n/8] ^= 0x80 >> (n % 8)
+	return netip.AddrFrom16(a)
+}
+
+// subtractCIDRs removes the subtracted prefixes from a list of CIDRs, splitting
+// any that partly overlap.  CIDRs that don't overlap are kept as they were
+// written.  It also returns the CIDRs that were changed.
+func subtractCIDRs(cidrs []string, subtract []netip.Prefix) ([]string, []string) {
+	result := make([]string, 0, len(cidrs))
+	changed := make([]string, 0)
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			result = append(result, cidr)
+			continue
+		}
+		remaining := SubtractPrefixes(p, subtract)
+		if len(remaining) == 1 && remaining[0] == p.Masked() {
+			result = append(result, cidr)
+			continue
+		}
+		changed = append(changed, cidr)
+		for _, r := range remaining {
+			result = append(result, r.String())
+		}
+	}
+	return result, changed
+}
+
+// removeLocalSubnets takes our own subnets out of the AllowedIPs of the peers,
+// so traffic to the local network isn't sent over the mesh.  A peer route
+// that contains a local subnet is split around it.
+func removeLocalSubnets(peers []model.Host, subnets []netip.Prefix) []model.Host {
+	for k := range peers {
+		allowed, changed := subtractCIDRs(peers[k].Current.AllowedIPs, subnets)
+		if len(changed) > 0 {
+			log.Infof("Excluded local subnets from AllowedIPs %s of %s, leaving %s", strings.Join(changed, ", "), peers[k].Name, strings.Join(allowed, ", "))
+		}
+		peers[k].Current.AllowedIPs = allowed
+	}
+	return peers
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	result := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		result = append(result, netip.MustParsePrefix(cidr))
+	}
+	return result
+}
+
+func TestSubtractPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		p, q string
+		want []netip.Prefix
+	}{
+		{
+			name: "/24 out of /8",
+			p:    "10.0.0.0/8",
+			q:    "10.1.2.0/24",
+			want: prefixes(
+				"10.128.0.0/9", "10.64.0.0/10", "10.32.0.0/11", "10.16.0.0/12",
+				"10.8.0.0/13", "10.4.0.0/14", "10.2.0.0/15", "10.0.0.0/16",
+				"10.1.128.0/17", "10.1.64.0/18", "10.1.32.0/19", "10.1.16.0/20",
+				"10.1.8.0/21", "10.1.4.0/22", "10.1.0.0/23", "10.1.3.0/24",
+			),
+		},
+		{"half", "10.0.0.0/24", "10.0.0.128/25", prefixes("10.0.0.0/25")},
+		{"exact match", "192.168.1.0/24", "192.168.1.0/24", prefixes()},
+		{"covered", "192.168.1.0/24", "192.168.0.0/16", prefixes()},
+		{"disjoint", "192.168.1.0/24", "10.0.0.0/8", prefixes("192.168.1.0/24")},
+		{"other family", "10.0.0.0/8", "::/0", prefixes("10.0.0.0/8")},
+		{"IPv4 out of IPv6", "::/0", "10.0.0.0/8", prefixes("::/0")},
+		{"IPv6", "2001:db8::/32", "2001:db8::/34", prefixes("2001:db8:8000::/33", "2001:db8:4000::/34")},
+		{"IPv6 host", "fd00::/126", "fd00::2/128", prefixes("fd00::/127", "fd00::3/128")},
+		{"not canonical", "10.1.2.3/8", "10.1.2.3/9", prefixes("10.128.0.0/9")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SubtractPrefix(netip.MustParsePrefix(tt.p), netip.MustParsePrefix(tt.q))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SubtractPrefix(%s, %s) = %v, want %v", tt.p, tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        string
+		subtract []netip.Prefix
+		want     []netip.Prefix
+	}{
+		{"none", "10.0.0.0/8", nil, prefixes("10.0.0.0/8")},
+		{"two", "10.0.0.0/22", prefixes("10.0.0.0/24", "10.0.3.0/24"), prefixes("10.0.2.0/24", "10.0.1.0/24")},
+		{"all of it", "10.0.0.0/23", prefixes("10.0.1.0/24", "10.0.0.0/24"), prefixes()},
+		{"nested", "10.0.0.0/16", prefixes("10.0.1.0/24", "10.0.0.0/23"), prefixes("10.0.128.0/17", "10.0.64.0/18", "10.0.32.0/19", "10.0.16.0/20", "10.0.8.0/21", "10.0.4.0/22", "10.0.2.0/23")},
+		{"mixed families", "10.0.0.0/24", prefixes("fd00::/8", "10.0.0.0/25", "192.168.0.0/16"), prefixes("10.0.0.128/25")},
+		{"not canonical", "10.0.0.5/24", prefixes("172.16.0.0/12"), prefixes("10.0.0.0/24")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SubtractPrefixes(netip.MustParsePrefix(tt.p), tt.subtract)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SubtractPrefixes(%s, %v) = %v, want %v", tt.p, tt.subtract, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractCIDRs(t *testing.T) {
+	tests := []struct {
+		name        string
+		cidrs       []string
+		subtract    []netip.Prefix
+		want        []string
+		wantChanged []string
+	}{
+		{
+			name:        "split",
+			cidrs:       []string{"10.9.0.0/24", "192.168.0.0/23"},
+			subtract:    prefixes("192.168.1.0/24"),
+			want:        []string{"10.9.0.0/24", "192.168.0.0/24"},
+			wantChanged: []string{"192.168.0.0/23"},
+		},
+		{
+			name:        "removed",
+			cidrs:       []string{"192.168.1.0/24", "fd00::/64"},
+			subtract:    prefixes("192.168.0.0/16"),
+			want:        []string{"fd00::/64"},
+			wantChanged: []string{"192.168.1.0/24"},
+		},
+		{
+			name:        "kept as written",
+			cidrs:       []string{" 10.1.2.3/8", "fd00::1/64"},
+			subtract:    prefixes("192.168.0.0/16", "fd01::/64"),
+			want:        []string{" 10.1.2.3/8", "fd00::1/64"},
+			wantChanged: []string{},
+		},
+		{
+			name:        "unparsable",
+			cidrs:       []string{"bogus", "10.0.0.1", "0.0.0.0/0"},
+			subtract:    prefixes("0.0.0.0/1"),
+			want:        []string{"bogus", "10.0.0.1", "128.0.0.0/1"},
+			wantChanged: []string{"0.0.0.0/0"},
+		},
+		{
+			name:        "nothing subtracted",
+			cidrs:       []string{"0.0.0.0/0", "::/0"},
+			subtract:    nil,
+			want:        []string{"0.0.0.0/0", "::/0"},
+			wantChanged: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := subtractCIDRs(tt.cidrs, tt.subtract)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subtractCIDRs(%q) = %q, want %q", tt.cidrs, got, tt.want)
+			}
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("subtractCIDRs(%q) changed %q, want %q", tt.cidrs, changed, tt.wantChanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Restart a subsystem that failed after this long, doubling up to the maximum
+const (
+	restartDelay    = time.Second
+	restartMaxDelay = time.Minute
+)
+
+// Supervisor runs the agent's subsystems under one context, restarts any
+// that fail, and shuts them all down in order
+type Supervisor struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	running map[string]int
+	hooks   []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// NewSupervisor creates a supervisor whose subsystems stop when parent is done
+func NewSupervisor(parent context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(parent)
+	return &Supervisor{
+		ctx:     ctx,
+		cancel:  cancel,
+		running: make(map[string]int),
+	}
+}
+
+// Context is done once shutdown has started
+func (s *Supervisor) Context() context.Context {
+	return s.ctx
+}
+
+// Go runs fn in a goroutine.  If it panics or returns an error it is started
+// again after a delay, until the supervisor is shut down.  Returning nil means
+// the subsystem is finished.
+func (s *Supervisor) Go(name string, fn func(ctx context.Context) error) {
+	s.wg.Add(1)
+	s.lock.Lock()
+	s.running[name]++
+	s.lock.Unlock()
+
+	go func() {
+		defer func() {
+			s.lock.Lock()
+			s.running[name]--
+			if s.running[name] == 0 {
+				delete(s.running, name)
+			}
+			s.lock.Unlock()
+			s.wg.Done()
+		}()
+
+		delay := restartDelay
+		for {
+			err := s.run(name, fn)
+			if err == nil || s.ctx.Err() != nil {
+				return
+			}
+			log.Errorf("%s failed, restarting in %v: %v", name, delay, err)
+			if !sleepContext(s.ctx, delay) {
+				return
+			}
+			delay *= 2
+			if delay > restartMaxDelay {
+				delay = restartMaxDelay
+			}
+		}
+	}()
+}
+
+// run calls fn, turning a panic into an error
+func (s *Supervisor) run(name string, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(s.ctx)
+}
+
+// OnShutdown adds a step to the shutdown, run in the order they were added
+func (s *Supervisor) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.hooks = append(s.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// Shutdown cancels the context and waits for every subsystem to return, so
+// nothing changes the network under the shutdown steps, then runs the steps.
+// Each stage gives up after timeout.
+func (s *Supervisor) Shutdown(timeout time.Duration) error {
+	s.cancel()
+
+	var result error
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	select {
+	case <-done:
+	case <-timer.C:
+		result = fmt.Errorf("timed out waiting for %v", s.Running())
+	}
+	timer.Stop()
+
+	s.lock.Lock()
+	hooks := make([]shutdownHook, len(s.hooks))
+	copy(hooks, s.hooks)
+	s.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, hook := range hooks {
+		log.Infof("Shutdown: %s", hook.name)
+		err := hook.fn(ctx)
+		if err != nil {
+			log.Errorf("Shutdown: %s: %v", hook.name, err)
+		}
+	}
+	return result
+}
+
+// Running returns the names of the subsystems that have not returned
+func (s *Supervisor) Running() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartAgent starts the host subsystems of the agent.  Cancelling ctx or calling
+// StopAgent shuts it down.
+func StartAgent(ctx context.Context) *Supervisor {
+	s := NewSupervisor(ctx)
+
+	// once the subsystems have returned, undo what the agent set up on the network
+	s.OnShutdown("DNS", StopDNS)
+	s.OnShutdown("port mappings", RemovePortMappings)
+	if config.ShutdownMeshes {
+		s.OnShutdown("meshes", StopMeshes)
+	}
+
+	DoWork(s)
+	return s
+}
+
+// StopAgent shuts the agent down within config.ShutdownTimeout
+func StopAgent(s *Supervisor) {
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	err := s.Shutdown(timeout)
+	if err != nil {
+		log.Errorf("Shutdown incomplete: %v", err)
+	}
+}
+
+// StopMeshes brings down every mesh, for agents configured with ShutdownMeshes
+func StopMeshes(ctx context.Context) error {
+	// let a reconcile in progress finish, and keep any other from starting
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	msg, err := LoadMessages()
+	if err != nil {
+		return err
+	}
+	for _, mesh := range msg.Config {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = StopWireguard(mesh.MeshName)
+		if err != nil {
+			log.Errorf("Error stopping %s: %v", mesh.MeshName, err)
+		}
+	}
+	return nil
+}
+
+// sleepContext sleeps for d, returning false if ctx was done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
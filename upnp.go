@@ -1,14 +1,110 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/huin/goupnp/dcps/internetgateway1"
-	"github.com/meshify-app/meshify/model"
 	log "github.com/sirupsen/logrus"
 )
 
+// upnpClient is what WANIPConnection1 and WANPPPConnection1 clients have in
+// common
+type upnpClient interface {
+	GetExternalIPAddress() (string, error)
+	AddPortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32) error
+	DeletePortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) error
+}
+
+// upnpMapper maps ports with UPnP IGDv1
+type upnpMapper struct {
+	client upnpClient
+	local  net.IP
+}
+
+// newUPnPMapper finds a UPnP gateway, with a WANIPConnection or failing that
+// a WANPPPConnection
+func newUPnPMapper(local net.IP) (*upnpMapper, error) {
+	clients, _, err := internetgateway1.NewWANIPConnection1Clients()
+	if err != nil {
+		log.Infof("Error discovering UPnP WANIPConnection: %v", err)
+	}
+	if len(clients) > 0 {
+		return &upnpMapper{client: clients[0], local: local}, nil
+	}
+
+	ppp, _, err := internetgateway1.NewWANPPPConnection1Clients()
+	if err != nil {
+		log.Infof("Error discovering UPnP WANPPPConnection: %v", err)
+	}
+	if len(ppp) > 0 {
+		return &upnpMapper{client: ppp[0], local: local}, nil
+	}
+	return nil, errors.New("no UPnP gateway found")
+}
+
+func (m *upnpMapper) Protocol() string {
+	return "UPnP"
+}
+
+func (m *upnpMapper) ExternalAddress() (net.IP, error) {
+	address, err := m.client.GetExternalIPAddress()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, errors.New("invalid external address " + address)
+	}
+	return ip, nil
+}
+
+// upnpOnlyPermanentLeases is the error of an IGDv1 gateway that only takes
+// a lease duration of 0
+const upnpOnlyPermanentLeases = "725"
+
+// MapPort replaces any mapping of the port, which may be left from before a
+// restart, since some gateways refuse to add one that exists
+func (m *upnpMapper) MapPort(port uint16, lifetime time.Duration, description string) (*PortMapping, error) {
+	m.client.DeletePortMapping("", port, "UDP")
+
+	log.Infof("***UPNP*** AddPortMapping: %d UDP %d %s %s", port, port, m.local, description)
+	err := m.client.AddPortMapping("", port, "UDP", port, m.local.String(), true, description, uint32(lifetime/time.Second))
+	if err != nil && strings.Contains(err.Error(), upnpOnlyPermanentLeases) {
+		log.Infof("***UPNP*** Gateway only has permanent leases")
+		lifetime = 0
+		err = m.client.AddPortMapping("", port, "UDP", port, m.local.String(), true, description, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PortMapping{
+		Protocol:     m.Protocol(),
+		Description:  description,
+		InternalPort: port,
+		ExternalPort: port,
+		Lifetime:     lifetime,
+	}, nil
+}
+
+// Renew adds the mapping again, which extends its lease
+func (m *upnpMapper) Renew(mapping *PortMapping, lifetime time.Duration) (*PortMapping, error) {
+	err := m.client.AddPortMapping("", mapping.ExternalPort, "UDP", mapping.InternalPort, m.local.String(), true, mapping.Description, uint32(lifetime/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	renewed := *mapping
+	renewed.Lifetime = lifetime
+	return &renewed, nil
+}
+
+func (m *upnpMapper) UnmapPort(mapping *PortMapping) error {
+	log.Infof("***UPNP*** DeletePortMapping: %d %s", mapping.ExternalPort, mapping.Description)
+	return m.client.DeletePortMapping("", mapping.ExternalPort, "UDP")
+}
+
 func isBogon(ip string) bool {
 	// Check to see if the ip address is a bogon
 	// https://en.wikipedia.org/wiki/Bogon_filtering
@@ -29,118 +125,3 @@ func isBogon(ip string) bool {
 	}
 	return false
 }
-
-func ConfigureUPnP(host model.Host) error {
-
-	if host.Current.UPnP {
-
-		log.Infof("***UPNP*** Configuring UPnP for %s", host.Name)
-		clients, _, err := internetgateway1.NewWANIPConnection1Clients()
-
-		if err != nil {
-			log.Error("WAN Error discovering gateway, upnp likely not supported. %v", err)
-		}
-		if len(clients) == 0 {
-			log.Error("***UPNP***WAN No gateway found, upnp likely not supported.")
-		}
-		for _, c := range clients {
-
-			if host.Current.ListenPort != 0 && host.Current.Endpoint != "" {
-				// get local ip address
-				conn, err := net.Dial("udp", "8.8.8.8:53")
-				if err != nil {
-					log.Error("Impossible to get local ip address")
-				} else {
-					defer conn.Close()
-					localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-					// get the external ip address
-					externalIP, err := c.GetExternalIPAddress()
-					if err != nil {
-						log.Error("Error getting external ip address, %v", err)
-					} else {
-						log.Infof("***UPNP*** External IP address: %s", externalIP)
-						// compare the externalIP to the endpoint
-						parts := strings.Split(host.Current.Endpoint, ":")
-						if parts[0] != externalIP && !isBogon(externalIP) {
-							log.Error("External IP address does not match endpoint")
-							// Update the host endpoint at meshify
-							host.Current.Endpoint = externalIP + ":" + parts[1]
-							UpdateMeshifyHost(host)
-						}
-					}
-
-					// delete any old port mappings
-					err = c.DeletePortMapping("", uint16(host.Current.ListenPort), "UDP")
-					if err != nil {
-						log.Error("Error deleting port mapping, %v", err)
-					}
-
-					log.Infof("***UPNP*** AddPortMapping: %d %s %d %s %s", host.Current.ListenPort, "UDP", host.Current.ListenPort, localAddr.IP.String(), host.Name+"-"+host.MeshName)
-					// add port mapping
-					err = c.AddPortMapping("", uint16(host.Current.ListenPort), "UDP", uint16(host.Current.ListenPort), localAddr.IP.String(), true, host.Name+"-"+host.MeshName, 0)
-					if err != nil {
-						log.Error("Error adding port mapping, %v", err)
-					}
-				}
-			}
-		}
-
-		ppp, _, err := internetgateway1.NewWANPPPConnection1Clients()
-		if err != nil { // no ppp connection
-			log.Error("Error discovering PPP gateway, likely doesn not exist. %v", err)
-			return err
-		}
-		if len(ppp) == 0 {
-			log.Error("No PPP gateway found, likely does not exist.")
-			return err
-		}
-
-		log.Info("PPP gateway found, configuring external IP and port mapping.")
-
-		for _, c := range ppp {
-
-			if host.Current.ListenPort != 0 && host.Current.Endpoint != "" {
-				// get local ip address
-				conn, err := net.Dial("udp", "8.8.8.8:53")
-				if err != nil {
-					log.Error("Impossible to get local ip address")
-				} else {
-					defer conn.Close()
-					localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-					// get the external ip address
-					externalIP, err := c.GetExternalIPAddress()
-					if err != nil {
-						log.Error("PPP Error getting external ip address, %v", err)
-					} else {
-						log.Infof("***UPNP***PPP External IP address: %s", externalIP)
-						// compare the externalIP to the endpoint
-						parts := strings.Split(host.Current.Endpoint, ":")
-						if parts[0] != externalIP && !isBogon(externalIP) {
-							log.Error("PPP External IP address does not match endpoint")
-							// Update the host endpoint at meshify
-							host.Current.Endpoint = externalIP + ":" + parts[1]
-							UpdateMeshifyHost(host)
-						}
-					}
-
-					// delete any old port mappings
-					err = c.DeletePortMapping("", uint16(host.Current.ListenPort), "UDP")
-					if err != nil {
-						log.Error("PPP Error deleting port mapping, %v", err)
-					}
-
-					log.Infof("***UPNP***PPP AddPortMapping: %d %s %d %s %s", host.Current.ListenPort, "UDP", host.Current.ListenPort, localAddr.IP.String(), host.Name+"-"+host.MeshName)
-					// add port mapping
-					err = c.AddPortMapping("", uint16(host.Current.ListenPort), "UDP", uint16(host.Current.ListenPort), localAddr.IP.String(), true, host.Name+"-"+host.MeshName, 0)
-					if err != nil {
-						log.Error("PPP Error adding port mapping, %v", err)
-					}
-				}
-			}
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// userspaceDriver runs wireguard-go inside the agent on a tun interface, for
+// kernels without wireguard.  The interface is set up as the netlink driver
+// does, through the same UAPI socket wg uses.
+type userspaceDriver struct {
+	lock    sync.Mutex
+	devices map[string]*userspaceDevice
+}
+
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+var userspace = &userspaceDriver{devices: make(map[string]*userspaceDevice)}
+
+func init() {
+	RegisterDriver("userspace", userspace)
+}
+
+func (u *userspaceDriver) Up(meshName string, conf []byte) error {
+	c, err := parseWireguardConfig(conf)
+	if err != nil {
+		return err
+	}
+	return bringUp(meshName, c, u.create, u.remove)
+}
+
+func (u *userspaceDriver) Down(meshName string) error {
+	return bringDown(meshName, u.remove)
+}
+
+func (u *userspaceDriver) ApplyPeers(meshName string, changes *PeerChanges) error {
+	return changes.Apply(meshName)
+}
+
+func (u *userspaceDriver) Stats(meshName string) (string, error) {
+	return wgctrlStats(meshName)
+}
+
+func (u *userspaceDriver) Interfaces() ([]string, error) {
+	return wgctrlInterfaces()
+}
+
+// Running is true if the mesh is a device of this driver
+func (u *userspaceDriver) Running(meshName string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	_, found := u.devices[meshName]
+	return found
+}
+
+func (u *userspaceDriver) create(meshName string) error {
+	tunDevice, err := tun.CreateTUN(meshName, device.DefaultMTU)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", meshName, err)
+	}
+
+	logger := device.NewLogger(device.LogLevelError, "("+meshName+") ")
+	dev := device.NewDevice(tunDevice, conn.NewDefaultBind(), logger)
+
+	file, err := ipc.UAPIOpen(meshName)
+	if err != nil {
+		dev.Close()
+		return fmt.Errorf("error opening the UAPI socket of %s: %v", meshName, err)
+	}
+	uapi, err := ipc.UAPIListen(meshName, file)
+	if err != nil {
+		dev.Close()
+		return fmt.Errorf("error listening on the UAPI socket of %s: %v", meshName, err)
+	}
+
+	go func() {
+		for {
+			c, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(c)
+		}
+	}()
+
+	u.lock.Lock()
+	u.devices[meshName] = &userspaceDevice{device: dev, uapi: uapi}
+	u.lock.Unlock()
+
+	log.Infof("Created %s in userspace", meshName)
+	return nil
+}
+
+// remove closes the device, which deletes the tun interface
+func (u *userspaceDriver) remove(meshName string) error {
+	u.lock.Lock()
+	d, found := u.devices[meshName]
+	delete(u.devices, meshName)
+	u.lock.Unlock()
+
+	if !found {
+		return deleteLink(meshName)
+	}
+	d.uapi.Close()
+	d.device.Close()
+	return nil
+}
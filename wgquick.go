@@ -0,0 +1,80 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// wgQuickDriver runs wg-quick, which sets up the interface, routes and DNS
+// with the tools installed on the host
+type wgQuickDriver struct{}
+
+func init() {
+	RegisterDriver("wg-quick", wgQuickDriver{})
+}
+
+func (wgQuickDriver) Up(meshName string, conf []byte) error {
+	return wgQuick("up", meshName)
+}
+
+func (wgQuickDriver) Down(meshName string) error {
+	return wgQuick("down", meshName)
+}
+
+func (wgQuickDriver) ApplyPeers(meshName string, changes *PeerChanges) error {
+	return changes.Apply(meshName)
+}
+
+func (wgQuickDriver) Stats(meshName string) (string, error) {
+	out, err := exec.Command("wg", "show", meshName, "transfer").Output()
+	if err != nil {
+		return "", fmt.Errorf("%v (%s)", err, string(out))
+	}
+	return string(out), nil
+}
+
+// Interfaces also finds the meshes wg-quick runs on a utun device on macOS,
+// which it names in /var/run/wireguard
+func (wgQuickDriver) Interfaces() ([]string, error) {
+	found := make(map[string]bool)
+	names, err := wgctrlInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		found[name] = true
+	}
+	if infos, err := ioutil.ReadDir("/var/run/wireguard"); err == nil {
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".name") {
+				found[strings.TrimSuffix(info.Name(), ".name")] = true
+			}
+		}
+	}
+
+	names = make([]string, 0, len(found))
+	for name := range found {
+		if !strings.HasPrefix(name, "utun") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func wgQuick(verb string, meshName string) error {
+	cmd := exec.Command(bashPath, "wg-quick", verb, meshName)
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("wg-quick %s %s: %v (%s)", verb, meshName, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}